@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// maxChecksums is the maximum number of checksums remembered by -checksum.
+const maxChecksums = 10000
+
+// checksums is the checksum of the contents of each file
+// as of its last change, for -checksum.
+var checksums = make(map[string][sha256.Size]byte)
+
+// contentChanged returns whether the contents of the file p
+// differ from when it was last checked.
+// Files that are new, removed, or unreadable are considered changed,
+// as are directories.
+func contentChanged(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		delete(checksums, p)
+		return true
+	}
+	defer f.Close()
+	if s, err := f.Stat(); err != nil || s.IsDir() {
+		return true
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		delete(checksums, p)
+		return true
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	old, ok := checksums[p]
+	if !ok && len(checksums) >= maxChecksums {
+		for q := range checksums {
+			delete(checksums, q)
+			break
+		}
+	}
+	checksums[p] = sum
+	return !ok || sum != old
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultConfig is the config file read if -config is not given.
+const defaultConfig = ".watchrc"
+
+// configAliases maps config file keys to the names of the flags they set.
+// A flag can also be set using its own name as the key.
+var configAliases = map[string]string{
+	"verbose":    "v",
+	"terminal":   "t",
+	"exclude":    "x",
+	"include":    "i",
+	"extensions": "e",
+	"path":       "p",
+	"delay":      "d",
+	"dir":        "C",
+}
+
+// envFlags maps environment variables to the names of the flags they set.
+var envFlags = map[string]string{
+	"WATCH_EXCLUDE": "x",
+	"WATCH_PATH":    "p",
+	"WATCH_DELAY":   "d",
+}
+
+// loadEnv sets flags that were not given on the command line
+// from the environment variables in envFlags.
+// WATCH_PATH may list several paths, separated like $PATH.
+func loadEnv() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for env, name := range envFlags {
+		val := os.Getenv(env)
+		if val == "" || set[name] {
+			continue
+		}
+		vals := []string{val}
+		if name == "p" {
+			vals = filepath.SplitList(val)
+		}
+		for _, v := range vals {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("bad value for %s: %s", env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadConfig sets flags that were not given on the command line
+// from the config file, and returns the command it specifies, if any.
+//
+// Each non-blank line of the file that doesn't begin with # has the form
+// key = value, where key is a flag name, an alias for one,
+// or command, whose value is the command split on spaces.
+// Keys for repeatable flags, like path, may be given more than once.
+//
+// A line of the form [name] begins a rule, which runs its own command
+// for changes beneath its own paths. The lines following it,
+// up to the next rule, set the rule's path, which may be given
+// more than once, exclude, a regexp, and command.
+//
+// If file is empty, the default config file is read if it exists.
+func loadConfig(file string) ([]string, error) {
+	return readConfig(file, nil)
+}
+
+// filterFlags is the names of the flags that are re-read by reloadFilters.
+var filterFlags = map[string]bool{
+	"x":             true,
+	"i":             true,
+	"e":             true,
+	"glob":          true,
+	"prune":         true,
+	"ignore":        true,
+	"ignore-create": true,
+	"watch-for":     true,
+}
+
+// reloadFilters re-reads the filter flags that were not given
+// on the command line from the config file and sets the filters from them.
+// Filter flags no longer in the file return to their defaults.
+// On error, the filters are unchanged.
+func reloadFilters() error {
+	for name := range filterFlags {
+		if f := flag.Lookup(name); !commandLine[name] {
+			f.Value.Set(f.DefValue)
+		}
+	}
+	if _, err := readConfig(*configFile, filterFlags); err != nil {
+		return err
+	}
+	return setFilters()
+}
+
+// commandLine is the set of flags given on the command line.
+var commandLine map[string]bool
+
+// readConfig is loadConfig, but if keys is non-nil,
+// only flags in keys are set.
+func readConfig(file string, keys map[string]bool) ([]string, error) {
+	if commandLine == nil {
+		commandLine = make(map[string]bool)
+		flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+	}
+	explicit := file != ""
+	if !explicit {
+		file = defaultConfig
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var command []string
+	var rs []*rule
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			rs = append(rs, &rule{name: strings.TrimSpace(line[1 : len(line)-1])})
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", file, n)
+		}
+		key, val := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(rs) > 0 {
+			if err := rs[len(rs)-1].setKey(key, val); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, n, err)
+			}
+			continue
+		}
+		if key == "command" {
+			command = strings.Fields(val)
+			continue
+		}
+		name := key
+		if a, ok := configAliases[key]; ok {
+			name = a
+		}
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown key %s", file, n, key)
+		}
+		if commandLine[name] || keys != nil && !keys[name] {
+			continue
+		}
+		if err := flag.Set(name, val); err != nil {
+			return nil, fmt.Errorf("%s:%d: bad value for %s: %s", file, n, key, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.New(file + ": " + err.Error())
+	}
+	for _, r := range rs {
+		if len(r.paths) == 0 || len(r.command) == 0 {
+			return nil, fmt.Errorf("%s: rule [%s] needs a path and a command", file, r.name)
+		}
+	}
+	if keys == nil {
+		rules = rs
+	}
+	return command, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// A filter is an io.Writer that pipes the data written to it
+// through the -filter command, which writes to the underlying writer.
+type filter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// startFilter starts the -filter command, writing its output to out.
+func startFilter(out io.Writer) (*filter, error) {
+	cmd := exec.Command("sh", "-c", *filterCmd)
+	cmd.Dir = *runDir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	setProcessGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &filter{cmd: cmd, stdin: stdin}, nil
+}
+
+// Write writes data to the filter's standard input.
+// Errors are ignored, so that the command is not blocked
+// writing to a full pipe if the filter exits early.
+func (f *filter) Write(data []byte) (int, error) {
+	f.stdin.Write(data)
+	return len(data), nil
+}
+
+// Close closes the filter's standard input and waits for it to exit,
+// killing it if it hasn't exited after a second.
+func (f *filter) Close() error {
+	f.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- f.cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		debugPrint("Filter still running after its input closed, killing it")
+		killGroup(f.cmd, syscall.SIGKILL)
+		return <-done
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// listed is the set of paths read from the -from list.
+var listed = make(map[string]bool)
+
+// isListFile returns whether p is the -from list file.
+func isListFile(p string) bool {
+	return *from != "" && *from != "-" && path.Clean(p) == path.Clean(*from)
+}
+
+// readList returns the paths listed one per line in the file p,
+// or in standard input if p is "-". Blank lines are skipped.
+func readList(p string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if p != "-" {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var ps []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if l := strings.TrimSpace(s.Text()); l != "" {
+			ps = append(ps, path.Clean(l))
+		}
+	}
+	return ps, s.Err()
+}
+
+// watchList watches the paths in the -from list, without recursing,
+// and stops watching those that are no longer listed.
+func watchList(w fileWatcher) {
+	ps, err := readList(*from)
+	if err != nil {
+		log.Printf("Failed to read %s: %s", *from, err)
+		return
+	}
+	next := make(map[string]bool)
+	for _, p := range ps {
+		next[p] = true
+		if !listed[p] {
+			watchedFiles[p] = true
+			watch(w, p)
+		}
+	}
+	for p := range listed {
+		if !next[p] {
+			debugPrint("Unwatching %s, it is no longer listed", p)
+			w.Remove(p)
+			removeWatched(p)
+			delete(watchedFiles, p)
+		}
+	}
+	listed = next
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// gitDir returns the git directory of the repository containing
+// the current directory.
+func gitDir() (string, error) {
+	out, err := exec.Command("git", "rev-parse", "--git-dir").Output()
+	if err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+			return "", errors.New(strings.TrimSpace(string(ee.Stderr)))
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// watchGit watches the HEAD and index files of the git repository,
+// for -git. Like paths in the -from list, they are watched
+// regardless of filters, and re-watched when git replaces them.
+func watchGit(w fileWatcher) error {
+	dir, err := gitDir()
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{"HEAD", "index"} {
+		p := path.Join(dir, f)
+		listed[p] = true
+		watchedFiles[p] = true
+		watch(w, p)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// gitignores maps each watched directory to the .gitignore patterns
+// that apply to its entries, including those inherited from its parents.
+var gitignores = make(map[string]ignoreList)
+
+// An ignorePattern is a single pattern from a .gitignore file.
+type ignorePattern struct {
+	// base is the directory containing the .gitignore file.
+	base string
+	glob string
+	// negate is set for patterns beginning with !,
+	// which re-include previously ignored paths.
+	negate bool
+	// dirOnly is set for patterns ending with /,
+	// which only match directories.
+	dirOnly bool
+	// anchored is set for patterns containing a /
+	// anywhere but the end, which match relative to base
+	// instead of against the base name at any depth.
+	// An anchored pattern beginning with **/ matches at any depth.
+	anchored bool
+}
+
+type ignoreList []ignorePattern
+
+// ignored returns whether p is ignored by the patterns of l.
+// The last matching pattern wins.
+func (l ignoreList) ignored(p string, isdir bool) bool {
+	var ign bool
+	for _, pat := range l {
+		if pat.match(p, isdir) {
+			ign = !pat.negate
+		}
+	}
+	return ign
+}
+
+func (pat ignorePattern) match(p string, isdir bool) bool {
+	if pat.dirOnly && !isdir {
+		return false
+	}
+	rel, err := filepath.Rel(pat.base, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return false
+	}
+	if !pat.anchored {
+		rel = path.Base(rel)
+	}
+	return matchGlob(pat.glob, rel)
+}
+
+// gitignored returns whether p is ignored by the .gitignore files
+// loaded for its directory. The .git directory is always ignored.
+func gitignored(p string, isdir bool) bool {
+	if !*useGitignore {
+		return false
+	}
+	if isdir && path.Base(p) == ".git" {
+		return true
+	}
+	return gitignores[path.Dir(path.Clean(p))].ignored(p, isdir)
+}
+
+// loadGitignore records the patterns that apply to the entries of dir:
+// those of its parent directory followed by those of dir/.gitignore.
+func loadGitignore(dir string) {
+	if !*useGitignore {
+		return
+	}
+	dir = path.Clean(dir)
+	var l ignoreList
+	if parent := path.Dir(dir); parent != dir {
+		l = append(l, gitignores[parent]...)
+	}
+	pats, err := readGitignore(dir)
+	if err != nil {
+		debugPrint("Failed to read %s/.gitignore: %s", dir, err)
+	}
+	gitignores[dir] = append(l, pats...)
+}
+
+// readGitignore returns the patterns in dir/.gitignore.
+// It returns no patterns and no error if the file does not exist.
+func readGitignore(dir string) ([]ignorePattern, error) {
+	f, err := os.Open(path.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pats []ignorePattern
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pat := ignorePattern{base: dir}
+		if strings.HasPrefix(line, "!") {
+			pat.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pat.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if rest := strings.TrimPrefix(line, "**/"); !strings.Contains(rest, "/") {
+			line = rest
+		}
+		if strings.Contains(line, "/") {
+			pat.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		pat.glob = line
+		pats = append(pats, pat)
+	}
+	return pats, s.Err()
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitignore(t *testing.T) {
+	dir := t.TempDir()
+	data := "*.o\n/top\nsub/dir/\n**/foo/bar\n"
+	if err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	pats, err := readGitignore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ignoreList(pats)
+	tests := []struct {
+		path  string
+		isdir bool
+		want  bool
+	}{
+		{"a.o", false, true},
+		{"x/y/a.o", false, true},
+		{"top", false, true},
+		{"x/top", false, false},
+		{"sub/dir", true, true},
+		{"sub/dir", false, false},
+		{"x/sub/dir", true, false},
+		{"foo/bar", false, true},
+		{"x/foo/bar", false, true},
+		{"x/y/foo/bar", false, true},
+		{"x/foo/baz", false, false},
+	}
+	for _, test := range tests {
+		p := filepath.Join(dir, test.path)
+		if got := l.ignored(p, test.isdir); got != test.want {
+			t.Errorf("ignored(%q, %v)=%v, want %v", test.path, test.isdir, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// An httpUI serves the output of the most recent run over HTTP.
+//
+// It serves these paths:
+//
+//	/ is an HTML page that displays the output live.
+//	/output is the plain text output of the most recent run.
+//	/status is the status of the most recent run.
+//	/events is a stream of server-sent events with the output as it is written.
+//	/rerun reruns the command when it receives a POST.
+type httpUI struct {
+	rr chan string
+
+	mu     sync.Mutex
+	out    bytes.Buffer
+	status string
+	// subs is the set of /events subscribers.
+	// A subscriber that falls behind is closed and removed;
+	// its client reconnects and receives the full output again.
+	subs map[chan string]bool
+}
+
+func newHTTPUI(addr string) (ui, error) {
+	h := &httpUI{
+		rr:     make(chan string),
+		status: "running",
+		subs:   make(map[chan string]bool),
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", h.serveIndex)
+	mux.HandleFunc("/output", h.serveOutput)
+	mux.HandleFunc("/status", h.serveStatus)
+	mux.HandleFunc("/events", h.serveEvents)
+	mux.HandleFunc("/rerun", h.serveRerun)
+	go func() {
+		log.Fatalln("HTTP server failed:", http.Serve(l, mux))
+	}()
+	return h, nil
+}
+
+func (h *httpUI) rerun() <-chan string { return h.rr }
+
+func (h *httpUI) redisplay(r runInfo) {
+	h.mu.Lock()
+	h.out.Reset()
+	h.status = "running"
+	h.broadcast(sseMessage("reset", "") + sseMessage("status", h.status))
+	h.mu.Unlock()
+
+	r.write(httpWriter{h})
+}
+
+// setStatus records the exit status of the most recent run.
+func (h *httpUI) setStatus(status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.status = "exit status " + strconv.Itoa(status)
+	h.broadcast(sseMessage("status", h.status))
+}
+
+// broadcast sends msg to all subscribers.
+// It must be called with h.mu held.
+func (h *httpUI) broadcast(msg string) {
+	for c := range h.subs {
+		select {
+		case c <- msg:
+		default:
+			debugPrint("Dropping slow /events subscriber")
+			close(c)
+			delete(h.subs, c)
+		}
+	}
+}
+
+// sseMessage returns a server-sent event with the given name and
+// the data JSON-encoded, so that it fits on a single data line.
+func sseMessage(event, data string) string {
+	d, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return "event: " + event + "\ndata: " + string(d) + "\n\n"
+}
+
+type httpWriter struct{ *httpUI }
+
+func (h httpWriter) Write(data []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.out.Write(data)
+	h.broadcast(sseMessage("output", string(data)))
+	return len(data), nil
+}
+
+func (h *httpUI) serveOutput(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	out := h.out.String()
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, out)
+}
+
+func (h *httpUI) serveStatus(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	status := h.status
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, status+"\n")
+}
+
+func (h *httpUI) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	c := make(chan string, 256)
+	h.mu.Lock()
+	msg := sseMessage("reset", "") + sseMessage("output", h.out.String()) + sseMessage("status", h.status)
+	h.subs[c] = true
+	h.mu.Unlock()
+
+	if _, err := io.WriteString(w, msg); err != nil {
+		h.unsubscribe(c)
+		return
+	}
+	flusher.Flush()
+	for {
+		select {
+		case msg, ok := <-c:
+			if !ok {
+				return
+			}
+			if _, err := io.WriteString(w, msg); err != nil {
+				h.unsubscribe(c)
+				return
+			}
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			h.unsubscribe(c)
+			return
+		}
+	}
+}
+
+func (h *httpUI) unsubscribe(c chan string) {
+	h.mu.Lock()
+	delete(h.subs, c)
+	h.mu.Unlock()
+}
+
+func (h *httpUI) serveRerun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	kill()
+	h.rr <- "POST /rerun"
+	io.WriteString(w, "ok\n")
+}
+
+func (h *httpUI) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, indexHTML)
+}
+
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head><title>Watch</title></head>
+<body>
+<div><button onclick="fetch('/rerun', {method: 'POST'})">Rerun</button> <span id="status"></span></div>
+<pre id="output"></pre>
+<script>
+var outputElem = document.getElementById("output");
+var statusElem = document.getElementById("status");
+var events = new EventSource("/events");
+events.addEventListener("reset", function() { outputElem.textContent = ""; });
+events.addEventListener("output", function(e) { outputElem.textContent += JSON.parse(e.data); });
+events.addEventListener("status", function(e) { statusElem.textContent = JSON.parse(e.data); });
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,152 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	ossignal "os/signal"
+	"reflect"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The name of the syscall.SysProcAttr.Setpgid field.
+const setpgidName = "Setpgid"
+
+var hasSetPGID bool
+
+// checkProcessGroups sets hasSetPGID if commands
+// can be started in their own process group.
+func checkProcessGroups() {
+	t := reflect.TypeOf(syscall.SysProcAttr{})
+	f, ok := t.FieldByName(setpgidName)
+	if ok && f.Type.Kind() == reflect.Bool {
+		debugPrint("syscall.SysProcAttr.Setpgid exists and is a bool")
+		hasSetPGID = true
+	} else if ok {
+		debugPrint("syscall.SysProcAttr.Setpgid exists but is a %s, not a bool", f.Type.Kind())
+	} else {
+		debugPrint("syscall.SysProcAttr.Setpgid does not exist")
+	}
+}
+
+// setProcessGroup sets cmd to start in its own process group, if supported.
+func setProcessGroup(cmd *exec.Cmd) {
+	if hasSetPGID {
+		var attr syscall.SysProcAttr
+		reflect.ValueOf(&attr).Elem().FieldByName(setpgidName).SetBool(true)
+		cmd.SysProcAttr = &attr
+	}
+}
+
+// setControllingTerminal sets cmd to start in a new session
+// with its standard input as its controlling terminal.
+// The session leader is also the leader of a new process group.
+func setControllingTerminal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+}
+
+// processGroup returns the process group ID of the command,
+// or 0 if it isn't in its own process group.
+func processGroup(cmd *exec.Cmd) int {
+	if !hasSetPGID {
+		return 0
+	}
+	return cmd.Process.Pid
+}
+
+// setNice sets the niceness of the started command,
+// and of its process group, if it has its own.
+func setNice(cmd *exec.Cmd, n int) error {
+	if hasSetPGID {
+		return syscall.Setpriority(syscall.PRIO_PGRP, cmd.Process.Pid, n)
+	}
+	return syscall.Setpriority(syscall.PRIO_PROCESS, cmd.Process.Pid, n)
+}
+
+// limitMemory returns args run by a shell that first limits its
+// address space, and so that of the command, to mb megabytes.
+// The limit is inherited by the command's children.
+func limitMemory(args []string, mb int) ([]string, error) {
+	lim := "ulimit -v " + strconv.Itoa(mb*1024) + ` && exec "$@"`
+	return append([]string{"sh", "-c", lim, "sh"}, args...), nil
+}
+
+// exitSignal returns the signal that killed the exited command, if any.
+func exitSignal(cmd *exec.Cmd) (syscall.Signal, bool) {
+	ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return 0, false
+	}
+	return ws.Signal(), true
+}
+
+// peakMemory returns the peak resident memory, in megabytes,
+// of the exited command or of the largest of its waited-for children.
+func peakMemory(cmd *exec.Cmd) (int, bool) {
+	ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0, false
+	}
+	// Maxrss is in kilobytes on Linux, the only system supporting -memlimit.
+	return int(ru.Maxrss / 1024), true
+}
+
+// killGroup sends sig to the command, or to its process group if supported.
+func killGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	p := cmd.Process.Pid
+	if hasSetPGID {
+		p = -p
+	}
+	syscall.Kill(p, sig)
+}
+
+// reapGroup waits until the command exits and then until no process
+// remains in its process group, sending SIGKILL to the group if any remain
+// after the -kill-timeout, so that killed commands don't leave children
+// holding resources, such as ports.
+func reapGroup(cmd *exec.Cmd) {
+	if !hasSetPGID {
+		return
+	}
+	for syscall.Kill(cmd.Process.Pid, 0) == nil {
+		time.Sleep(5 * time.Millisecond)
+	}
+	grace := *killTimeout
+	if grace == 0 {
+		grace = time.Second
+	}
+	pg := -cmd.Process.Pid
+	killed := false
+	for deadline := time.Now().Add(grace); syscall.Kill(pg, 0) == nil; {
+		switch {
+		case !killed && time.Now().After(deadline):
+			debugPrint("Process group remains, sending SIGKILL")
+			syscall.Kill(pg, syscall.SIGKILL)
+			killed = true
+			deadline = time.Now().Add(5 * time.Second)
+		case killed && time.Now().After(deadline):
+			log.Printf("Processes remain in process group %d", -pg)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// notifyWatched relays the signal that requests the list of watched paths to c.
+func notifyWatched(c chan<- os.Signal) {
+	ossignal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyReload relays the signal that requests reloading the filters to c.
+func notifyReload(c chan<- os.Signal) {
+	ossignal.Notify(c, syscall.SIGHUP)
+}
+
+func mkfifo(p string) error {
+	return syscall.Mkfifo(p, 0666)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func checkProcessGroups() {}
+
+// setProcessGroup sets cmd to start in its own process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+func setControllingTerminal(cmd *exec.Cmd) {}
+
+func processGroup(cmd *exec.Cmd) int { return 0 }
+
+func setNice(cmd *exec.Cmd, n int) error {
+	return errors.New("-nice is not supported on Windows")
+}
+
+// killGroup kills the command and its descendants with taskkill.
+// Windows has no signals, so any signal but SIGKILL asks the processes to close,
+// and SIGKILL, or a failure to ask, forcibly terminates them.
+func killGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if sig != syscall.SIGKILL {
+		if err := exec.Command("taskkill", "/T", "/PID", pid).Run(); err == nil {
+			return
+		}
+		debugPrint("taskkill failed, forcing")
+	}
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", pid).Run(); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// reapGroup does nothing; killGroup kills the descendants.
+func reapGroup(cmd *exec.Cmd) {}
+
+// notifyWatched does nothing; Windows has no SIGUSR1.
+func notifyWatched(c chan<- os.Signal) {}
+
+// notifyReload does nothing; Windows has no SIGHUP.
+func notifyReload(c chan<- os.Signal) {}
+
+func limitMemory(args []string, mb int) ([]string, error) {
+	return args, errors.New("-memlimit is not supported on Windows")
+}
+
+// exitSignal returns false; Windows commands aren't killed by signals.
+func exitSignal(cmd *exec.Cmd) (syscall.Signal, bool) { return 0, false }
+
+// peakMemory returns false; -memlimit isn't supported on Windows.
+func peakMemory(cmd *exec.Cmd) (int, bool) { return 0, false }
+
+func mkfifo(p string) error {
+	return errors.New("FIFOs are not supported on Windows")
+}
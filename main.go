@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
@@ -9,11 +10,14 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	ossignal "os/signal"
 	"path"
-	"reflect"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -21,222 +25,1784 @@ import (
 )
 
 var (
-	debug     = flag.Bool("v", false, "Enable verbose debugging output")
-	term      = flag.Bool("t", false, "Just run in the terminal (instead of an acme win)")
-	exclude   = flag.String("x", "", "Exclude files and directories matching this regular expression")
-	watchPath = flag.String("p", ".", "The path to watch")
+	debug            = flag.Bool("v", false, "Enable verbose debugging output")
+	term             = flag.Bool("t", false, "Just run in the terminal (instead of an acme win)")
+	exclude          = flag.String("x", "", "Exclude files and directories matching this regular expression")
+	include          = flag.String("i", "", "Only rerun for files matching this regular expression")
+	delay            = flag.Duration("d", rebuildDelay, "The time to wait for changes to settle before rerunning; 0 reruns on every change")
+	clear            = flag.Bool("clear", false, "Clear the terminal before each run (with -t)")
+	useGitignore     = flag.Bool("gitignore", false, "Skip files and directories ignored by .gitignore files")
+	killTimeout      = flag.Duration("kill-timeout", 5*time.Second, "The time to wait after the -sig signal before sending SIGKILL; 0 only sends SIGKILL on a second kill")
+	poll             = flag.Duration("poll", 0, "Poll for changes at this interval instead of using filesystem notifications")
+	timeout          = flag.Duration("timeout", 0, "Kill the command if it runs longer than this; 0 means no timeout")
+	notifyFlag       = flag.Bool("notify", false, "Send a desktop notification when the command starts failing or passing")
+	duration         = flag.Bool("duration", false, "Print the elapsed time of each run")
+	maxRuns          = flag.Int("n", 0, "Exit with the command's exit status after this many runs; 0 runs indefinitely")
+	maxDepth         = flag.Int("depth", -1, "The maximum depth of subdirectories to watch; negative is unlimited")
+	followSymlinks   = flag.Bool("follow-symlinks", false, "Watch directories beneath symbolic links to directories")
+	exts             = flag.String("e", "", "Only rerun for files with these comma-separated extensions")
+	dryRun           = flag.Bool("dry-run", false, "Log the changes that would trigger a rerun instead of running the command")
+	sigName          = flag.String("sig", "TERM", "The signal sent first to kill the command: TERM, INT, HUP, QUIT, or KILL")
+	httpAddr         = flag.String("http", "", "Serve the output over HTTP at this address (instead of an acme win or the terminal)")
+	color            = flag.Bool("color", false, "Color the exit status and time lines when writing to a terminal")
+	initCmd          = flag.String("init", "", "A command to run once at startup instead of the first run of the command")
+	quiet            = flag.Bool("q", false, "Only show the command's output if it fails")
+	runDir           = flag.String("C", "", "Run the command in this directory")
+	restart          = flag.Bool("restart", false, "Run the command as a long-running server, killing and restarting it on each change")
+	keepPos          = flag.Bool("keep-pos", false, "Keep the position of dot in the acme win across reruns, if it is not at the top")
+	noEcho           = flag.Bool("no-echo", false, "Don't print the command before running it")
+	configFile       = flag.String("config", "", "Read default flag values and the command from this file (default .watchrc, if it exists)")
+	runAtStart       = flag.Bool("run-at-start", true, "Run the command at startup, before any change")
+	ignoreCreate     = flag.String("ignore-create", "", "Don't rerun when files matching this regular expression are created, only when they are later modified")
+	prune            = flag.String("prune", "", "Don't watch directories matching this regular expression, but still rerun for events of files matching it")
+	ignore           = flag.String("ignore", "", "Don't rerun for files matching this regular expression, but still watch directories matching it")
+	onSuccess        = flag.String("on-success", "", "A shell command to run after the command succeeds")
+	onFailure        = flag.String("on-failure", "", "A shell command to run after the command fails")
+	minInterval      = flag.Duration("min-interval", 0, "The minimum time between the starts of change-triggered runs")
+	logFile          = flag.String("log", "", "Append debugging and error messages to this file instead of standard error")
+	globs            = flag.String("glob", "", "Exclude files and directories matching these comma-separated glob patterns")
+	killEager        = flag.Bool("kill-eager", false, "Kill the command started by -restart on the first change, before the -d delay; requires -restart")
+	reuse            = flag.Bool("reuse", false, "Reuse an existing acme win with the same name instead of creating a new one")
+	ignoreChmod      = flag.Bool("ignore-chmod", true, "Don't rerun for events that only change file attributes")
+	triggerFile      = flag.String("trigger", "", "A FIFO; each line written to it reruns the command")
+	collapse         = flag.Bool("collapse", false, "Print a short line instead of the output if it is the same as the last run's")
+	only             = flag.String("only", "", "A comma-separated list of directories; only these are watched beneath the watched paths")
+	banner           = flag.Bool("banner", false, "Print a separator line with the time before each run")
+	listEvents       = flag.Bool("list-events", false, "Log each file system event with its operations and whether it triggers a rerun")
+	shell            = flag.Bool("shell", false, "Run the command with $SHELL -c, or sh -c if $SHELL is not set")
+	burst            = flag.Int("burst", 0, "If more than this many events arrive before a run, wait longer for changes to settle; 0 disables this")
+	burstMax         = flag.Duration("burst-max", 5*time.Second, "The longest time -burst waits for changes to settle")
+	font             = flag.String("font", "", "The font of the acme win")
+	tab              = flag.Int("tab", 0, "The tab width of the acme win, in zeros; 0 uses acme's default")
+	checksum         = flag.Bool("checksum", false, "Only rerun if the contents of a changed file differ, not just its modification time")
+	bell             = flag.Bool("bell", false, "Ring the terminal bell when the command fails, twice if it was passing")
+	from             = flag.String("from", "", "A file listing the paths to watch, one per line, or - for standard input; they are watched instead of recursing")
+	keepAlive        = flag.Bool("keep-alive", true, "Keep watching if the command fails to start; with false, exit")
+	waitClean        = flag.Bool("wait-clean", false, "Don't show the output of runs until the command first succeeds")
+	skipFirst        = flag.Bool("skip-first", false, "Don't show the output of the first run")
+	usePty           = flag.Bool("pty", false, "Run the command with a pseudo-terminal, so it behaves as if run in a terminal; Linux only")
+	onDelete         = flag.String("on-delete", "", "A shell command to run before the next run for each deleted file, which is its $1")
+	showHidden       = flag.Bool("hidden", false, "Watch hidden files and directories, whose names begin with .")
+	parallel         = flag.Int("parallel", 0, "The number of runs that may run at once; a change doesn't wait for the previous run to finish")
+	backoff          = flag.Duration("backoff", 0, "The longest minimum time between runs while the command keeps failing; 0 disables backoff")
+	winName          = flag.String("name", "+watch", "The suffix of the acme win's name, after the directory")
+	showPid          = flag.Bool("show-pid", false, "Print the process ID of the command when it starts")
+	nice             = flag.Int("nice", 0, "The niceness added to the command's scheduling priority, such as 10 to run it at low priority")
+	watchFor         = flag.String("watch-for", "", "Comma-separated glob patterns for the names of files, possibly not yet created, that are the only ones to trigger a rerun")
+	gitMode          = flag.Bool("git", false, "Watch the git HEAD and index instead of the working tree, rerunning on commits and checkouts")
+	maxOutput        = flag.Int("max-output", 0, "Truncate the output of each command after this many bytes; 0 means no limit")
+	keepRuns         = flag.Int("keep-runs", 1, "Keep the output of this many runs in the acme win, oldest first")
+	filterCmd        = flag.String("filter", "", "Pipe the output of the command through this shell command")
+	ignoreEditorTemp = flag.Bool("ignore-editor-temp", true, "Don't rerun for editors' backup, swap, and other temporary files")
+	delaySuccess     = flag.Duration("delay-after-success", -1, "The -d delay to use while the last run succeeded; negative means -d")
+	delayFailure     = flag.Duration("delay-after-failure", -1, "The -d delay to use while the last run failed; negative means -d")
+	statusFile       = flag.String("status-file", "", "After each run, write its exit status, time, and duration to this file as JSON")
+	chunkSize        = flag.Int("chunk-size", defaultChunkSize, "The maximum number of bytes written to the acme win's body at a time")
+	memLimit         = flag.Int("memlimit", 0, "Limit the address space of the command to this many megabytes, on Linux; 0 means no limit")
+	writesOnly       = flag.Bool("writes-only", false, "Only rerun when files are written, not when they are created, removed, or renamed")
 )
 
-var excludeRe *regexp.Regexp
+var watchPaths pathList
+
+// extCommands maps file extensions to the commands run when
+// files with those extensions change; see -map.
+var extCommands = make(extMap)
+
+func init() {
+	flag.Var(&watchPaths, "p", "A path to watch; may be repeated (default .)")
+	flag.Var(&extCommands, "map", "Run a different command, given as ext=command, for changes to files with the extension; may be repeated")
+}
+
+// An extMap is a flag.Value mapping file extensions to commands.
+type extMap map[string][]string
+
+func (m *extMap) String() string {
+	var ss []string
+	for ext, cmd := range *m {
+		ss = append(ss, ext+"="+strings.Join(cmd, " "))
+	}
+	return strings.Join(ss, ",")
+}
+
+func (m *extMap) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return errors.New("expected ext=command")
+	}
+	ext, cmd := s[:i], strings.Fields(s[i+1:])
+	if len(cmd) == 0 {
+		return errors.New("no command for " + ext)
+	}
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	(*m)[foldCase(ext)] = cmd
+	return nil
+}
+
+var excludeRe, includeRe, ignoreCreateRe, pruneRe, ignoreRe *regexp.Regexp
+
+// compileRegexp returns the compiled regexp expr, or nil if expr is empty.
+func compileRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.New("Bad regexp: " + expr)
+	}
+	return re, nil
+}
+
+// splitGlobs returns the comma-separated glob patterns in s, or nil if s is empty.
+func splitGlobs(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	gs := strings.Split(s, ",")
+	for _, g := range gs {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, errors.New("Bad glob: " + g)
+		}
+	}
+	return gs, nil
+}
+
+// setFilters sets the patterns that choose the files
+// that are watched and that trigger a rerun from their flags.
+// If any is bad, none are set.
+func setFilters() error {
+	var res [5]*regexp.Regexp
+	for i, expr := range []string{*exclude, *include, *ignoreCreate, *prune, *ignore} {
+		var err error
+		if res[i], err = compileRegexp(expr); err != nil {
+			return err
+		}
+	}
+	gs, err := splitGlobs(*globs)
+	if err != nil {
+		return err
+	}
+	wfs, err := splitGlobs(*watchFor)
+	if err != nil {
+		return err
+	}
+	var extMap map[string]bool
+	if *exts != "" {
+		extMap = make(map[string]bool)
+		for _, e := range strings.Split(*exts, ",") {
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			extMap[foldCase(e)] = true
+		}
+	}
+	excludeRe, includeRe, ignoreCreateRe, pruneRe, ignoreRe = res[0], res[1], res[2], res[3], res[4]
+	excludeGlobs, watchForGlobs, extensions = gs, wfs, extMap
+	return nil
+}
+
+// matches returns whether the regexp re is set and matches p,
+// relative to the watched path containing it.
+func matches(re *regexp.Regexp, p string) bool {
+	return re != nil && re.MatchString(relPath(p))
+}
+
+// watchRoots is the watched paths.
+var watchRoots []string
+
+// isRoot returns whether p is one of the watched paths.
+func isRoot(p string) bool {
+	for _, r := range watchRoots {
+		if path.Clean(p) == r {
+			return true
+		}
+	}
+	return false
+}
+
+// relPath returns p relative to the watched path containing it,
+// so that patterns anchor the same way at any depth,
+// however the path was watched.
+// The watched path itself is ".".
+func relPath(p string) string {
+	p = path.Clean(p)
+	var root string
+	for _, r := range watchRoots {
+		if (r == "." && !path.IsAbs(p) || p == r || strings.HasPrefix(p, r+"/")) && len(r) > len(root) {
+			root = r
+		}
+	}
+	switch {
+	case root == "" || root == ".":
+		return p
+	case p == root:
+		return "."
+	default:
+		return p[len(root)+1:]
+	}
+}
+
+// excludeGlobs is the glob patterns given by -glob.
+var excludeGlobs []string
+
+// excluded returns whether p matches -x or -glob.
+// A glob containing a / is matched against the whole relative path;
+// otherwise it is matched against the base name.
+// A leading **/ matches any number of directories.
+func excluded(p string) bool {
+	if matches(excludeRe, p) {
+		return true
+	}
+	for _, g := range excludeGlobs {
+		q := relPath(p)
+		if rest := strings.TrimPrefix(g, "**/"); !strings.Contains(rest, "/") {
+			g, q = rest, path.Base(q)
+		}
+		if matchGlob(g, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob returns whether the glob g matches the path p.
+// A leading **/ in g matches any number of leading directories of p,
+// including none.
+func matchGlob(g, p string) bool {
+	rest := strings.TrimPrefix(g, "**/")
+	if rest == g {
+		ok, _ := path.Match(g, p)
+		return ok
+	}
+	for {
+		if ok, _ := path.Match(rest, p); ok {
+			return true
+		}
+		i := strings.Index(p, "/")
+		if i < 0 {
+			return false
+		}
+		p = p[i+1:]
+	}
+}
+
+// watchForGlobs is the glob patterns given by -watch-for.
+var watchForGlobs []string
+
+// isWatchedFor returns whether the base name of p matches -watch-for,
+// or true if -watch-for was not given.
+// Unlike -i, -watch-for doesn't limit the directories that are watched,
+// so matching files created anywhere later trigger a rerun.
+func isWatchedFor(p string) bool {
+	if watchForGlobs == nil {
+		return true
+	}
+	for _, g := range watchForGlobs {
+		if ok, _ := path.Match(g, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pruned returns whether p should not be watched or walked into.
+func pruned(p string) bool {
+	return excluded(p) || matches(pruneRe, p) || hidden(p) ||
+		!inOnly(p) && !aboveOnly(p)
+}
+
+// ignored returns whether events for p should not trigger a rerun.
+func ignored(p string) bool {
+	return excluded(p) || matches(ignoreRe, p) || hidden(p) || editorTemp(p) || !inOnly(p)
+}
+
+// editorTemp returns whether p is named like the temporary files
+// of common editors, and -ignore-editor-temp is set:
+// backups ending in ~, emacs's #auto-saves# and .#locks,
+// vim's .swap files and 4913 probe file, kate's .kate-swp files,
+// and JetBrains's ___jb_tmp___ and ___jb_old___ files.
+func editorTemp(p string) bool {
+	if !*ignoreEditorTemp {
+		return false
+	}
+	name := path.Base(p)
+	if ext := path.Ext(name); strings.HasPrefix(name, ".") && len(ext) == 4 &&
+		strings.HasPrefix(ext, ".sw") && ext[3] >= 'a' && ext[3] <= 'p' {
+		return true
+	}
+	return strings.HasSuffix(name, "~") ||
+		len(name) > 1 && strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#") ||
+		strings.HasPrefix(name, ".#") ||
+		name == "4913" ||
+		strings.HasSuffix(name, ".kate-swp") ||
+		strings.HasSuffix(name, "___jb_tmp___") ||
+		strings.HasSuffix(name, "___jb_old___")
+}
+
+// hidden returns whether p is a hidden file or directory,
+// whose name begins with ., and -hidden is not set.
+// The watched paths themselves are never hidden.
+func hidden(p string) bool {
+	if *showHidden {
+		return false
+	}
+	rel := relPath(p)
+	return rel != "." && strings.HasPrefix(path.Base(rel), ".")
+}
+
+// onlyDirs is the absolute paths of the directories given by -only,
+// or nil if -only was not given.
+var onlyDirs []string
+
+// inOnly returns whether p is in one of the onlyDirs,
+// or true if -only was not given.
+func inOnly(p string) bool {
+	if onlyDirs == nil {
+		return true
+	}
+	p = absPath(p)
+	for _, d := range onlyDirs {
+		if p == d || strings.HasPrefix(p, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// aboveOnly returns whether p is a directory containing one of the onlyDirs.
+// These directories are walked, but events in them are ignored.
+func aboveOnly(p string) bool {
+	p = absPath(p)
+	for _, d := range onlyDirs {
+		if p == "/" || strings.HasPrefix(d, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// startDir is the working directory at startup, used by absPath.
+var startDir, _ = os.Getwd()
+
+func absPath(p string) string {
+	if !path.IsAbs(p) {
+		p = path.Join(startDir, p)
+	}
+	return path.Clean(p)
+}
+
+// extensions is the set of file extensions given by -e,
+// or nil if -e was not given.
+var extensions map[string]bool
+
+// hasExtension returns whether p has one of the extensions.
+func hasExtension(p string) bool {
+	return extensions == nil || extensions[foldCase(path.Ext(p))]
+}
+
+// foldCase returns s lower-cased on systems
+// whose filesystems are typically case-insensitive.
+func foldCase(s string) string {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		return strings.ToLower(s)
+	}
+	return s
+}
 
 const rebuildDelay = 200 * time.Millisecond
 
-// The name of the syscall.SysProcAttr.Setpgid field.
-const setpgidName = "Setpgid"
+// signals maps the names accepted by -sig to their signals.
+var signals = map[string]syscall.Signal{
+	"TERM": syscall.SIGTERM,
+	"INT":  syscall.SIGINT,
+	"HUP":  syscall.SIGHUP,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+}
+
+// ANSI escape sequences used by -color.
+const (
+	green = "\033[32m"
+	red   = "\033[31m"
+	dim   = "\033[2m"
+	reset = "\033[0m"
+)
+
+var (
+	// useColor is whether to color output; see -color.
+	useColor bool
+	// termSignal is the signal first sent to kill the command.
+	termSignal = syscall.SIGTERM
+)
+
+// A pathList is a flag.Value collecting the values of a repeated flag.
+type pathList []string
+
+func (l *pathList) String() string { return strings.Join(*l, ",") }
+
+func (l *pathList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// A change is a change to a watched file.
+type change struct {
+	// path is the path of the changed file.
+	path string
+	// time is the modification time of the change.
+	time time.Time
+	// op is the operations of the change's event.
+	// It is 0 when polling.
+	op fsnotify.Op
+}
+
+// A runInfo describes a run for a ui to display.
+type runInfo struct {
+	// command is the command, with its stages separated by --.
+	command string
+	// start is the time the run started.
+	start time.Time
+	// reason is why the command was run other than changes, such as Get.
+	reason string
+	// trigger is the distinct paths changed since the last run.
+	trigger []string
+	// write runs the command, writing its output to the Writer,
+	// and returns its exit status.
+	write func(io.Writer) int
+}
+
+type ui interface {
+	// redisplay replaces the displayed output with that of the run.
+	redisplay(runInfo)
+	// The reason, such as Get, is sent when the command should be rerun.
+	rerun() <-chan string
+}
+
+// A statusUI is a ui that displays the exit status of each run.
+type statusUI interface {
+	ui
+	setStatus(int)
+}
+
+type writerUI struct{ io.Writer }
+
+// clearScreen is the ANSI escape sequence to clear the screen
+// and move the cursor to the top-left corner.
+const clearScreen = "\033[H\033[2J"
+
+func (w writerUI) redisplay(r runInfo) {
+	if *clear {
+		io.WriteString(w, clearScreen)
+	}
+	r.write(w)
+}
+
+func (w writerUI) rerun() <-chan string { return nil }
+
+// infoWriter returns where to write the watched paths
+// and the summary on SIGUSR1 for the ui:
+// the terminal, the win's body, or, for -http, standard error.
+func infoWriter(ui ui) io.Writer {
+	switch u := ui.(type) {
+	case writerUI:
+		return u
+	case winUI:
+		return bodyWriter{u.win}
+	default:
+		return os.Stderr
+	}
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] command [command args…]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	commandArgs = flag.Args()
+	if err := loadEnv(); err != nil {
+		log.Fatalln(err)
+	}
+	switch cmd, err := loadConfig(*configFile); {
+	case err != nil:
+		log.Fatalln("Failed to read the config:", err)
+	case len(commandArgs) == 0:
+		commandArgs = cmd
+	}
+
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+		if err != nil {
+			log.Printf("Failed to open the log file, logging to standard error: %s", err)
+		} else {
+			log.SetOutput(f)
+		}
+	}
+
+	checkProcessGroups()
+
+	sig, ok := signals[strings.TrimPrefix(strings.ToUpper(*sigName), "SIG")]
+	if !ok {
+		log.Fatalln("Bad signal:", *sigName)
+	}
+	termSignal = sig
+
+	if len(commandArgs) == 0 && len(rules) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	checkCommands(commands(""))
+	for _, args := range extCommands {
+		checkCommands([][]string{args})
+	}
+	for _, r := range rules {
+		checkCommands(split(r.command, ""))
+	}
+	if *initCmd != "" {
+		checkCommands([][]string{strings.Fields(*initCmd)})
+	}
+
+	if *runDir != "" {
+		switch isdir, err := isDir(*runDir); {
+		case err != nil:
+			log.Fatalf("Bad -C directory %s: %s", *runDir, err)
+		case !isdir:
+			log.Fatalf("Bad -C directory %s: no such directory", *runDir)
+		}
+	}
+
+	ui := ui(writerUI{os.Stdout})
+	if *httpAddr != "" {
+		var err error
+		if ui, err = newHTTPUI(*httpAddr); err != nil {
+			log.Fatalln("Failed to start the HTTP server:", err)
+		}
+	} else if !*term {
+		wd, err := os.Getwd()
+		if err != nil {
+			log.Fatalln("Failed to get the current directory")
+		}
+		if ui, err = newWin(wd); err != nil {
+			log.Fatalln("Failed to open a win:", err)
+		}
+	}
+
+	if _, ok := ui.(writerUI); ok && *color && isTerminal(os.Stdout) {
+		useColor = true
+	}
+
+	if err := setFilters(); err != nil {
+		log.Fatalln(err)
+	}
+	if *delaySuccess < 0 {
+		*delaySuccess = *delay
+	}
+	if *parallel > 1 && (*restart || *collapse || *waitClean || *skipFirst || *notifyFlag || *bell || *backoff > 0 || *delayFailure >= 0) {
+		log.Fatalln("-parallel cannot be used with -restart, -collapse, -wait-clean, -skip-first, -notify, -bell, -backoff, or -delay-after-failure")
+	}
+	if *delayFailure < 0 {
+		*delayFailure = *delay
+	}
+	if *only != "" {
+		onlyDirs = []string{}
+		for _, d := range strings.Split(*only, ",") {
+			onlyDirs = append(onlyDirs, absPath(d))
+		}
+	}
+
+	if *memLimit > 0 && runtime.GOOS != "linux" {
+		log.Fatalln("-memlimit is only supported on Linux")
+	}
+	if *restart && (*waitClean || *skipFirst) {
+		// The server's output would go to the buffer holding the run's output.
+		log.Fatalln("-restart cannot be used with -wait-clean or -skip-first")
+	}
+	if *killEager && !*restart {
+		log.Fatalln("-kill-eager requires -restart")
+	}
+
+	go handleSignals()
+	go func() {
+		c := make(chan os.Signal, 1)
+		notifyWatched(c)
+		out := infoWriter(ui)
+		for range c {
+			writeWatched(out)
+			writeSummary(out)
+		}
+	}()
+	go func() {
+		c := make(chan os.Signal, 1)
+		notifyReload(c)
+		for range c {
+			reload()
+		}
+	}()
+
+	var triggers <-chan struct{}
+	if *triggerFile != "" {
+		triggers = readTrigger(*triggerFile)
+	}
+
+	for _, r := range rules {
+		r.paths = resolveSymlinks(r.paths)
+	}
+	if len(watchPaths) == 0 && len(commandArgs) == 0 && len(extCommands) == 0 {
+		watchPaths = rulePaths()
+	}
+	if len(watchPaths) == 0 {
+		watchPaths = pathList{"."}
+	}
+	w := newWatcher(ui, flagConfig(), startWatching(watchPaths), triggers)
+	if *initCmd != "" {
+		w.doRun(appendJob(nil, "init", [][]string{strings.Fields(*initCmd)}), "-init")
+	}
+	w.loop()
+}
+
+// checkCommands warns about the stages whose commands aren't found,
+// so that a typo is seen at startup instead of on the first change.
+func checkCommands(stages [][]string) {
+	for _, args := range stages {
+		if len(args) == 0 {
+			continue
+		}
+		args = shellCommand(args)
+		if *runDir != "" && strings.Contains(args[0], "/") {
+			// Relative to the -C directory; exec.LookPath would be wrong.
+			continue
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			log.Printf("Warning: %s", err)
+		}
+	}
+}
+
+// A job is a command run for changes, as its stages.
+// A run may have several jobs, from -map or the rules of the config file,
+// each of which runs whether or not the others fail.
+type job struct {
+	// name identifies the job in the output of runs with several jobs.
+	name   string
+	stages [][]string
+}
+
+// appendJob returns jobs with the named job appended,
+// unless it has no stages.
+func appendJob(jobs []job, name string, stages [][]string) []job {
+	if len(stages) == 0 {
+		return jobs
+	}
+	return append(jobs, job{name: name, stages: stages})
+}
+
+// jobsFor returns the jobs to run for changes to paths.
+// changed is the most recently changed path.
+// If there are rules in the config file, see ruleJobs.
+//
+// For each extension in extCommands of the changed paths,
+// its command is run once, with placeholder replaced by the
+// most recently changed path with that extension.
+// The default command is run first if any changed path
+// has no mapped extension, or if there are no changed paths.
+func jobsFor(paths []string, changed string) []job {
+	if len(rules) > 0 {
+		return ruleJobs(paths, changed)
+	}
+	return mapJobs(paths, changed)
+}
+
+// mapJobs returns the jobs to run for changes to paths,
+// ignoring the rules.
+func mapJobs(paths []string, changed string) []job {
+	if len(extCommands) == 0 {
+		return appendJob(nil, "default", commands(changed))
+	}
+	var exts []string
+	newest := make(map[string]string)
+	// unmapped is the newest changed path with no mapped extension,
+	// which replaces the placeholder in the default command.
+	unmapped, runDefault := changed, len(paths) == 0
+	for _, p := range paths {
+		ext := foldCase(path.Ext(p))
+		if _, ok := extCommands[ext]; !ok {
+			unmapped, runDefault = p, true
+			continue
+		}
+		if _, ok := newest[ext]; !ok {
+			exts = append(exts, ext)
+		}
+		newest[ext] = p
+	}
+	var jobs []job
+	if runDefault {
+		jobs = appendJob(jobs, "default", commands(unmapped))
+	}
+	for _, ext := range exts {
+		var args []string
+		for _, a := range extCommands[ext] {
+			args = append(args, strings.Replace(a, placeholder, newest[ext], -1))
+		}
+		jobs = appendJob(jobs, ext, [][]string{args})
+	}
+	return jobs
+}
+
+// commandArgs is the command given on the command line or in the config.
+var commandArgs []string
+
+// placeholder is replaced in command arguments by the changed path.
+const placeholder = "{}"
+
+// separator separates the stages of the command.
+const separator = "--"
+
+// commands returns the stages of the command, separated by separator,
+// with placeholder replaced by changed,
+// the path of the most recent change within the debounce window.
+// If changed is empty, because nothing has changed yet,
+// arguments that are exactly the placeholder are omitted.
+func commands(changed string) [][]string {
+	return split(commandArgs, changed)
+}
+
+// split returns the stages of the command cmd, separated by separator,
+// with placeholder replaced by changed, as for commands.
+func split(cmd []string, changed string) [][]string {
+	var stages [][]string
+	var args []string
+	for _, a := range cmd {
+		switch {
+		case a == separator:
+			if len(args) > 0 {
+				stages = append(stages, args)
+			}
+			args = nil
+		case changed == "" && a == placeholder:
+			continue
+		default:
+			args = append(args, strings.Replace(a, placeholder, changed, -1))
+		}
+	}
+	if len(args) > 0 {
+		stages = append(stages, args)
+	}
+	return stages
+}
+
+// shellCommand returns args to run with the shell if -shell is set,
+// or args itself if not.
+func shellCommand(args []string) []string {
+	if !*shell {
+		return args
+	}
+	sh := os.Getenv("SHELL")
+	if sh == "" {
+		sh = "sh"
+	}
+	return []string{sh, "-c", strings.Join(args, " ")}
+}
+
+// commandString returns the jobs as a command,
+// with their stages separated by --, and the jobs by ;.
+func commandString(jobs []job) string {
+	var js []string
+	for _, j := range jobs {
+		var cmds []string
+		for _, args := range j.stages {
+			cmds = append(cmds, strings.Join(args, " "))
+		}
+		js = append(js, strings.Join(cmds, " "+separator+" "))
+	}
+	return strings.Join(js, " ; ")
+}
+
+// run runs the jobs in order, displaying their output on the ui.
+// Each job runs whether or not the previous ones failed,
+// but if a stage of a job fails, the job's remaining stages are not run.
+// events is the number of change events since the last run,
+// trigger is the distinct paths that they changed,
+// and deleted is those that were deleted, for -on-delete.
+// It returns the time at which the run finished and the exit status,
+// which is that of the first job that failed, if any.
+func run(ui ui, jobs []job, reason string, events int, trigger, deleted []string) (time.Time, int) {
+	var status int
+	start := time.Now()
+	info := runInfo{
+		command: commandString(jobs),
+		start:   start,
+		reason:  reason,
+		trigger: trigger,
+	}
+	info.write = func(out io.Writer) int {
+		if *banner {
+			io.WriteString(out, "----- run at "+start.Format("15:04:05")+" -----\n")
+		}
+		for _, err := range takeWatchErrors() {
+			io.WriteString(out, "watcher error: "+err+"\n")
+		}
+		if reason != "" {
+			io.WriteString(out, "triggered by: "+reason+"\n")
+		}
+		if len(trigger) > 0 {
+			msg := "triggered by changes to " + strconv.Itoa(len(trigger)) + " files, " + strconv.Itoa(events) + " events coalesced"
+			if *debug {
+				msg += ": " + strings.Join(trigger, " ")
+			}
+			io.WriteString(out, msg+"\n")
+		}
+		w := out
+		var buf bytes.Buffer
+		if *collapse && !*restart {
+			w = &buf
+		}
+		for _, p := range deleted {
+			if _, err := os.Stat(p); err == nil {
+				debugPrint("Not running -on-delete for %s, it exists again", p)
+				continue
+			}
+			io.WriteString(w, "on-delete: "+*onDelete+" "+p+"\n")
+			runStage(w, []string{"sh", "-c", *onDelete, "sh", p}, trigger, false)
+		}
+		var line string
+		for i, j := range jobs {
+			if len(jobs) > 1 && !*noEcho {
+				io.WriteString(w, "["+j.name+"]\n")
+			}
+			background := *restart && i == len(jobs)-1
+			s, l := runStages(w, j.stages, trigger, background)
+			if len(jobs) > 1 {
+				io.WriteString(w, "["+j.name+"] exit status "+strconv.Itoa(s)+"\n")
+			}
+			if s != 0 && status == 0 {
+				status, line = s, l
+			}
+		}
+		hook, name := *onSuccess, "on-success"
+		if status != 0 {
+			hook, name = *onFailure, "on-failure"
+		}
+		if hook != "" {
+			io.WriteString(w, name+": "+hook+"\n")
+			runStage(w, []string{"sh", "-c", hook}, trigger, false)
+		}
+		if w == &buf {
+			writeCollapsed(out, buf.String(), status)
+		}
+		elapsed := time.Since(start)
+		if *notifyFlag {
+			notifyStatus(status, line)
+		}
+		if _, ok := ui.(writerUI); ok && *bell {
+			ringBell(out, status)
+		}
+		if *duration {
+			io.WriteString(out, "elapsed: "+strconv.FormatFloat(elapsed.Seconds(), 'f', 3, 64)+"s\n")
+		}
+		if useColor {
+			io.WriteString(out, dim+time.Now().String()+reset+"\n")
+		} else {
+			io.WriteString(out, time.Now().String()+"\n")
+		}
+		return status
+	}
+
+	ranMu.Lock()
+	once, clean := ranOnce, ranClean
+	ranMu.Unlock()
+	if *skipFirst && !once || *waitClean && !clean {
+		var buf bytes.Buffer
+		info.write(&buf)
+		if status == 0 && !(*skipFirst && !once) {
+			info.write = func(out io.Writer) int {
+				out.Write(buf.Bytes())
+				return status
+			}
+			ui.redisplay(info)
+		} else {
+			debugPrint("Not showing the output of the run, exit status %d", status)
+		}
+	} else {
+		ui.redisplay(info)
+	}
+	ranMu.Lock()
+	ranOnce = true
+	ranClean = ranClean || status == 0
+	ranMu.Unlock()
+	recordRun(status, time.Since(start))
+	if *statusFile != "" {
+		if err := writeStatusFile(status, start); err != nil {
+			log.Printf("Failed to write the status file: %s", err)
+		}
+	}
+
+	return time.Now(), status
+}
+
+// runStages runs the stages of a job in order, writing their output to out,
+// and returns the exit status and the first line of standard error,
+// as runStage, of the last stage run.
+// If a stage fails, the remaining stages are not run.
+// If background is set, the last stage is run in the background, as by runStage.
+func runStages(out io.Writer, stages [][]string, trigger []string, background bool) (int, string) {
+	var status int
+	var line string
+	for i, args := range stages {
+		label := strings.Join(args, " ")
+		if len(stages) > 1 {
+			label = "[" + strconv.Itoa(i+1) + "/" + strconv.Itoa(len(stages)) + "] " + label
+		}
+		if !*noEcho {
+			io.WriteString(out, label+"\n")
+		}
+		bg := background && i == len(stages)-1
+		if status, line = runStage(out, shellCommand(args), trigger, bg); status != 0 {
+			if len(stages) > 1 {
+				io.WriteString(out, "stage "+strconv.Itoa(i+1)+" failed: "+strings.Join(args, " ")+"\n")
+			}
+			break
+		}
+	}
+	return status, line
+}
+
+var (
+	// ranMu guards ranOnce and ranClean, which are set by concurrent runs with -parallel.
+	ranMu sync.Mutex
+	// ranOnce is whether the command has run, for -skip-first.
+	ranOnce bool
+	// ranClean is whether the command has succeeded, for -wait-clean.
+	ranClean bool
+)
+
+// bellFailing is whether the previous run failed, for -bell.
+var bellFailing bool
+
+// ringBell writes the terminal bell to out if status is non-zero,
+// twice if the previous run passed, to tell new failures from persistent ones.
+func ringBell(out io.Writer, status int) {
+	switch {
+	case status != 0 && !bellFailing:
+		io.WriteString(out, "\a\a")
+	case status != 0:
+		io.WriteString(out, "\a")
+	}
+	bellFailing = status != 0
+}
+
+var (
+	// lastOutput and lastStatus are the output and exit status
+	// of the previous run with -collapse.
+	lastOutput string
+	lastStatus int
+	// repeats is the number of consecutive runs with lastOutput.
+	repeats int
+)
+
+// writeCollapsed writes output to out, or, if it and the status
+// are the same as the previous run's, a short line saying so.
+func writeCollapsed(out io.Writer, output string, status int) {
+	if repeats > 0 && output == lastOutput && status == lastStatus {
+		repeats++
+		io.WriteString(out, "(unchanged output, "+strconv.Itoa(repeats)+" consecutive)\n")
+		return
+	}
+	lastOutput, lastStatus, repeats = output, status, 1
+	io.WriteString(out, output)
+}
+
+// startFailed is the exit status reported for a command that failed to start,
+// like the shell's status for a command that is not found.
+const startFailed = 127
+
+// runStage runs the command args, writing its output to out.
+// It returns the exit status and the first line of standard error
+// if -notify is set.
+//
+// If background is set, runStage returns 0 once the command starts,
+// without waiting for it to exit, and serverDone is closed once it exits.
+func runStage(out io.Writer, args []string, trigger []string, background bool) (int, string) {
+	if *memLimit > 0 {
+		var err error
+		if args, err = limitMemory(args, *memLimit); err != nil {
+			log.Printf("Failed to limit the memory: %s", err)
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = *runDir
+	var last string
+	if len(trigger) > 0 {
+		last = trigger[len(trigger)-1]
+	}
+	cmd.Env = append(os.Environ(),
+		"WATCH_CHANGED_FILE="+last,
+		"WATCH_CHANGE_COUNT="+strconv.Itoa(len(trigger)))
+	dst := out
+	var quietBuf *tailBuffer
+	if *quiet && !background {
+		quietBuf = &tailBuffer{max: maxQuietOutput}
+		dst = quietBuf
+	}
+	if *maxOutput > 0 {
+		dst = &limitWriter{w: dst, max: *maxOutput}
+	}
+	var filt *filter
+	if *filterCmd != "" {
+		var err error
+		if filt, err = startFilter(dst); err != nil {
+			log.Printf("Failed to start the filter, not filtering: %s", err)
+		} else {
+			dst = filt
+		}
+	}
+	cmd.Stdout = dst
+	cmd.Stderr = dst
+	stderr := &firstLineWriter{Writer: dst}
+	if *notifyFlag {
+		var mu sync.Mutex
+		stderr.Writer = syncWriter{&mu, dst}
+		cmd.Stdout = syncWriter{&mu, dst}
+		cmd.Stderr = stderr
+	}
+	setProcessGroup(cmd)
+	var ptm, pts *os.File
+	// ptyOut is where the output read from the pty is written.
+	// Standard output and error are merged by the pty.
+	ptyOut := cmd.Stdout
+	if *usePty {
+		var err error
+		if ptm, pts, err = openPty(); err != nil {
+			log.Printf("Failed to open a pty, running without one: %s", err)
+		} else {
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = pts, pts, pts
+			setControllingTerminal(cmd)
+		}
+	}
+	start := time.Now()
+	kills, err := startCommand(cmd)
+	if err != nil {
+		if pts != nil {
+			ptm.Close()
+			pts.Close()
+		}
+		if filt != nil {
+			filt.Close()
+		}
+		if !*keepAlive {
+			log.Fatalln("Failed to start the command:", err)
+		}
+		io.WriteString(out, "failed to start: "+err.Error()+"\n")
+		return startFailed, err.Error()
+	}
+	if *nice != 0 {
+		if err := setNice(cmd, *nice); err != nil {
+			log.Printf("Failed to set the niceness: %s", err)
+		}
+	}
+	if *showPid {
+		msg := "pid: " + strconv.Itoa(cmd.Process.Pid)
+		if pg := processGroup(cmd); pg > 0 {
+			msg += " (process group " + strconv.Itoa(pg) + ")"
+		}
+		io.WriteString(out, msg+"\n")
+	}
+	var ptyDone chan struct{}
+	if pts != nil {
+		pts.Close()
+		ptyDone = make(chan struct{})
+		go func() {
+			// Reading fails once the command and its children close the pty.
+			io.Copy(ptyOut, ptm)
+			ptm.Close()
+			close(ptyDone)
+		}()
+	}
+	if background {
+		done := make(chan struct{})
+		serverDone = done
+		go func() {
+			s, _, _ := wait(start, cmd, kills)
+			if filt != nil {
+				filt.Close()
+			}
+			io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+			close(done)
+		}()
+		return 0, ""
+	}
+	s, timedOut, killed := wait(start, cmd, kills)
+	if ptyDone != nil {
+		select {
+		case <-ptyDone:
+		case <-time.After(time.Second):
+			// Children that outlive the command may hold the pty open.
+			debugPrint("pty still open after the command exited")
+		}
+	}
+	if filt != nil {
+		filt.Close()
+	}
+	switch {
+	case *quiet && s == 0:
+		io.WriteString(out, "ok\n")
+	case *quiet:
+		data := quietBuf.Bytes()
+		if quietBuf.dropped > 0 {
+			io.WriteString(out, "... "+strconv.Itoa(quietBuf.dropped)+" bytes of output dropped\n")
+		}
+		out.Write(data)
+	}
+	if timedOut {
+		io.WriteString(out, "timeout after "+timeout.String()+"\n")
+	}
+	if *memLimit > 0 && !killed && outOfMemory(cmd, s) {
+		writeMemLimit(out, cmd)
+	}
+	switch {
+	case useColor && s == 0:
+		io.WriteString(out, green+"exit status 0"+reset+"\n")
+	case useColor:
+		io.WriteString(out, red+"exit status "+strconv.Itoa(s)+reset+"\n")
+	case s != 0:
+		io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+	}
+	return s, string(stderr.line)
+}
+
+// outOfMemory returns whether the exited command, with exit status s,
+// looks like it failed to allocate memory: killed by SIGKILL, SIGSEGV,
+// or SIGABRT, as by the OOM killer or a runtime that can't handle
+// a failed allocation, or exiting with the status a shell reports
+// for a child killed by one of them.
+func outOfMemory(cmd *exec.Cmd, s int) bool {
+	if sig, ok := exitSignal(cmd); ok {
+		return sig == syscall.SIGKILL || sig == syscall.SIGSEGV || sig == syscall.SIGABRT
+	}
+	return s == 128+int(syscall.SIGKILL) || s == 128+int(syscall.SIGSEGV) || s == 128+int(syscall.SIGABRT)
+}
 
-var (
-	hasSetPGID bool
-	killChan   = make(chan time.Time, 1)
-)
+// writeMemLimit writes a note that the failed command may have
+// exceeded the -memlimit, with its peak resident memory if known.
+func writeMemLimit(out io.Writer, cmd *exec.Cmd) {
+	msg := "failed with a -memlimit of " + strconv.Itoa(*memLimit) + "MB"
+	if mb, ok := peakMemory(cmd); ok {
+		msg += " (peak resident memory " + strconv.Itoa(mb) + "MB)"
+	}
+	if sig, ok := exitSignal(cmd); ok {
+		msg += ", killed by " + sig.String()
+	}
+	io.WriteString(out, msg+"; it may have run out of memory\n")
+}
 
-type ui interface {
-	redisplay(func(io.Writer))
-	// An empty struct is sent when the command should be rerun.
-	rerun() <-chan struct{}
+// wait waits for the command started by startCommand to exit
+// and returns its exit status,
+// whether it was killed for running longer than the -timeout,
+// and whether Watch killed it, for the -timeout or any other reason.
+// The command is killed when kills receives.
+func wait(start time.Time, cmd *exec.Cmd, kills <-chan struct{}) (int, bool, bool) {
+	defer removeRunning(cmd)
+	done := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(done)
+	}()
+	k := killer{
+		signal:      func(sig syscall.Signal) { killGroup(cmd, sig) },
+		reap:        func() { reapGroup(cmd) },
+		timeout:     *timeout,
+		killTimeout: *killTimeout,
+	}
+	timedOut, killed := k.wait(start, done, kills)
+	return cmd.ProcessState.ExitCode(), timedOut, killed
 }
 
-type writerUI struct{ io.Writer }
+// A killer kills a command when told to, or when it times out.
+// It first sends the termSignal, and then SIGKILL
+// on a second kill or after the kill timeout.
+type killer struct {
+	// signal sends sig to the command, or to its process group.
+	signal func(sig syscall.Signal)
+	// reap returns once no process remains in the killed command's group.
+	reap func()
+	// timeout and killTimeout are the -timeout and -kill-timeout;
+	// zero means none.
+	timeout, killTimeout time.Duration
+}
 
-func (w writerUI) redisplay(f func(io.Writer)) { f(w) }
+// wait returns once done is closed, after the command exits,
+// killing it if kills receives or it runs longer than the timeout.
+// It returns whether the command was killed for the timeout,
+// and whether it was killed at all.
+func (k killer) wait(start time.Time, done, kills <-chan struct{}) (bool, bool) {
+	var timeoutC, killTimeoutC <-chan time.Time
+	if k.timeout > 0 {
+		t := time.NewTimer(k.timeout - time.Since(start))
+		defer t.Stop()
+		timeoutC = t.C
+	}
+	var n int
+	var timedOut bool
+	// reaped is closed once no process remains in the killed command's group.
+	// cmd.Wait doesn't return until then if they hold its output.
+	var reaped chan struct{}
+	term := func() {
+		k.signal(termSignal)
+		n++
+		reaped = make(chan struct{})
+		go func() {
+			k.reap()
+			close(reaped)
+		}()
+		if k.killTimeout > 0 {
+			killTimeoutC = time.After(k.killTimeout)
+		}
+	}
+	for {
+		select {
+		case <-done:
+			if reaped != nil {
+				<-reaped
+			}
+			return timedOut, n > 0
 
-func (w writerUI) rerun() <-chan struct{} { return nil }
+		case <-kills:
+			if n == 0 {
+				debugPrint("Sending %s", termSignal)
+				term()
+			} else {
+				debugPrint("Sending SIGKILL")
+				k.signal(syscall.SIGKILL)
+				n++
+			}
 
-func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: [flags] command [command args…]\n", os.Args[0])
-		flag.PrintDefaults()
-	}
-	flag.Parse()
+		case <-timeoutC:
+			if n == 0 {
+				debugPrint("Timed out, sending %s", termSignal)
+				timedOut = true
+				term()
+			}
 
-	t := reflect.TypeOf(syscall.SysProcAttr{})
-	f, ok := t.FieldByName(setpgidName)
-	if ok && f.Type.Kind() == reflect.Bool {
-		debugPrint("syscall.SysProcAttr.Setpgid exists and is a bool")
-		hasSetPGID = true
-	} else if ok {
-		debugPrint("syscall.SysProcAttr.Setpgid exists but is a %s, not a bool", f.Type.Kind())
-	} else {
-		debugPrint("syscall.SysProcAttr.Setpgid does not exist")
+		case <-killTimeoutC:
+			if n == 1 {
+				debugPrint("Kill timeout expired, sending SIGKILL")
+				k.signal(syscall.SIGKILL)
+				n++
+			}
+		}
 	}
+}
 
-	if flag.NArg() == 0 {
-		flag.Usage()
-		os.Exit(1)
+var (
+	runningMu sync.Mutex
+	// running is the started commands that haven't exited,
+	// several with -parallel, each with the channel
+	// on which kill tells its wait to kill it.
+	running = make(map[*exec.Cmd]chan struct{})
+	// killed is the running commands that have been told to be killed.
+	killed = make(map[*exec.Cmd]bool)
+	// exiting is set once Watch is exiting, after which no command starts.
+	exiting bool
+)
+
+// startCommand starts cmd, unless Watch is exiting,
+// and records it as running until wait returns.
+// It returns the channel on which the command is told to be killed.
+func startCommand(cmd *exec.Cmd) (<-chan struct{}, error) {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	if exiting {
+		return nil, errors.New("Watch is exiting")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
 	}
+	c := make(chan struct{}, 1)
+	running[cmd] = c
+	return c, nil
+}
 
-	ui := ui(writerUI{os.Stdout})
-	if !*term {
-		wd, err := os.Getwd()
-		if err != nil {
-			log.Fatalln("Failed to get the current directory")
-		}
-		if ui, err = newWin(wd); err != nil {
-			log.Fatalln("Failed to open a win:", err)
-		}
+func removeRunning(cmd *exec.Cmd) {
+	runningMu.Lock()
+	delete(running, cmd)
+	delete(killed, cmd)
+	runningMu.Unlock()
+}
+
+// runningCommands returns the commands being waited on.
+func runningCommands() []*exec.Cmd {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	var cmds []*exec.Cmd
+	for cmd := range running {
+		cmds = append(cmds, cmd)
 	}
+	return cmds
+}
 
-	if *exclude != "" {
-		var err error
-		excludeRe, err = regexp.Compile(*exclude)
-		if err != nil {
-			log.Fatalln("Bad regexp: ", *exclude)
+// handleSignals kills the running commands, if any, when Watch
+// receives SIGINT or SIGTERM, and then exits.
+// The commands are sent the -sig signal and then,
+// if they haven't exited after the -kill-timeout, SIGKILL.
+func handleSignals() {
+	c := make(chan os.Signal, 1)
+	ossignal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	debugPrint("Received %s", sig)
+	runningMu.Lock()
+	exiting = true
+	runningMu.Unlock()
+	cmds := runningCommands()
+	for _, cmd := range cmds {
+		killGroup(cmd, termSignal)
+	}
+	grace := *killTimeout
+	if grace == 0 {
+		grace = 5 * time.Second
+	}
+	for deadline := time.Now().Add(grace); len(cmds) > 0; cmds = runningCommands() {
+		if time.Now().After(deadline) {
+			debugPrint("Commands did not exit, sending SIGKILL")
+			for _, cmd := range cmds {
+				killGroup(cmd, syscall.SIGKILL)
+			}
+			break
 		}
+		time.Sleep(5 * time.Millisecond)
 	}
+	writeSummary(os.Stderr)
+	os.Exit(128 + int(sig.(syscall.Signal)))
+}
 
-	timer := time.NewTimer(0)
-	changes := startWatching(*watchPath)
-	lastRun := time.Time{}
-	lastChange := time.Now()
+// serverDone is closed when the command started by -restart exits.
+// It is nil if no command has been started.
+var serverDone chan struct{}
 
-	for {
+// stopServer kills the command started by -restart,
+// if it is running, and waits for it to exit.
+func stopServer() {
+	if serverDone == nil {
+		return
+	}
+	select {
+	case <-serverDone:
+		serverDone = nil
+		return
+	default:
+	}
+	// Get and POST /rerun may have already killed it,
+	// in which case it gets its -kill-timeout before SIGKILL.
+	terminate()
+	if *killTimeout == 0 {
+		// wait only sends SIGKILL on a second kill.
 		select {
-		case lastChange = <-changes:
-			timer.Reset(rebuildDelay)
-
-		case <-ui.rerun():
-			lastRun = run(ui)
-
-		case <-timer.C:
-			if lastRun.Before(lastChange) {
-				lastRun = run(ui)
-			}
+		case <-serverDone:
+		case <-time.After(5 * time.Second):
+			kill()
 		}
 	}
+	<-serverDone
+	serverDone = nil
 }
 
-func run(ui ui) time.Time {
-	ui.redisplay(func(out io.Writer) {
-		cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
-		cmd.Stdout = out
-		cmd.Stderr = out
-		if hasSetPGID {
-			var attr syscall.SysProcAttr
-			reflect.ValueOf(&attr).Elem().FieldByName(setpgidName).SetBool(true)
-			cmd.SysProcAttr = &attr
-		}
-		io.WriteString(out, strings.Join(flag.Args(), " ")+"\n")
-		start := time.Now()
-		if err := cmd.Start(); err != nil {
-			io.WriteString(out, "fatal: "+err.Error()+"\n")
-			os.Exit(1)
-		}
-		if s := wait(start, cmd); s != 0 {
-			io.WriteString(out, "exit status "+strconv.Itoa(s)+"\n")
+// kill kills every running command: the first kill sends the -sig signal,
+// and a second sends SIGKILL.
+// Commands started after the kill are not killed.
+func kill() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for cmd, c := range running {
+		select {
+		case c <- struct{}{}:
+			debugPrint("Killing")
+			killed[cmd] = true
+		default:
+			debugPrint("Kill already pending")
 		}
-		io.WriteString(out, time.Now().String()+"\n")
-	})
-
-	return time.Now()
+	}
 }
 
-func wait(start time.Time, cmd *exec.Cmd) int {
-	var n int
-	ticker := time.NewTicker(5 * time.Millisecond)
-	defer ticker.Stop()
-	for {
+// terminate kills every running command that hasn't already been killed,
+// sending it the -sig signal, but doesn't escalate to SIGKILL
+// for those that have, such as by Get before a -restart rerun.
+func terminate() {
+	runningMu.Lock()
+	defer runningMu.Unlock()
+	for cmd, c := range running {
+		if killed[cmd] {
+			continue
+		}
 		select {
-		case t := <-killChan:
-			if t.Before(start) {
-				continue
-			}
-			p := cmd.Process.Pid
-			if hasSetPGID {
-				p = -p
-			}
-			if n == 0 {
-				debugPrint("Sending SIGTERM")
-				syscall.Kill(p, syscall.SIGTERM)
-			} else {
-				debugPrint("Sending SIGKILL")
-				syscall.Kill(p, syscall.SIGKILL)
-			}
-			n++
-
-		case <-ticker.C:
-			var status syscall.WaitStatus
-			p := cmd.Process.Pid
-			switch q, err := syscall.Wait4(p, &status, syscall.WNOHANG, nil); {
-			case err != nil:
-				panic(err)
-			case q > 0:
-				cmd.Wait() // Clean up any goroutines created by cmd.Start.
-				return status.ExitStatus()
-			}
+		case c <- struct{}{}:
+			debugPrint("Terminating")
+			killed[cmd] = true
+		default:
 		}
 	}
 }
 
-func kill() {
-	select {
-	case killChan <- time.Now():
-		debugPrint("Killing")
+func startWatching(ps []string) <-chan change {
+	ps = resolveSymlinks(ps)
+	for _, p := range ps {
+		watchRoots = append(watchRoots, path.Clean(p))
+	}
+	if *from != "" && *poll > 0 {
+		log.Fatalln("-from cannot be used with -poll")
+	}
+	if *gitMode && (*from != "" || *poll > 0) {
+		log.Fatalln("-git cannot be used with -from or -poll")
+	}
+	if *poll > 0 {
+		changes := make(chan change)
+		go pollChanges(ps, *poll, changes)
+		return changes
 	}
-}
 
-func startWatching(p string) <-chan time.Time {
-	w, err := fsnotify.NewWatcher()
+	fw, err := fsnotify.NewWatcher()
 	if err != nil {
 		panic(err)
 	}
+	w := notifyWatcher{fw}
 
-	switch isdir, err := isDir(p); {
-	case err != nil:
-		log.Fatalf("Failed to watch %s: %s", p, err)
-	case isdir:
-		watchDir(w, p)
-	default:
-		watch(w, p)
+	if *from != "" {
+		watchList(w)
+		if isListFile(*from) {
+			watchedFiles[path.Clean(*from)] = true
+			watch(w, *from)
+		}
+		ps = nil
+	}
+	if *gitMode {
+		if err := watchGit(w); err != nil {
+			log.Fatalln("Failed to watch git:", err)
+		}
+		ps = nil
+	}
+	for _, p := range ps {
+		switch isdir, err := isDir(p); {
+		case err != nil:
+			log.Fatalf("Failed to watch %s: %s", p, err)
+		case isdir:
+			watchDir(w, p, 0)
+		default:
+			watchedFiles[path.Clean(p)] = true
+			watch(w, p)
+		}
+	}
+
+	if failedWatches > 0 {
+		log.Printf("%d paths could not be watched; changes to them will be missed", failedWatches)
 	}
 
-	changes := make(chan time.Time)
+	changes := make(chan change)
 
-	go sendChanges(w, changes)
+	go sendChanges(w, flagFilter, changes)
 
 	return changes
 }
 
-func sendChanges(w *fsnotify.Watcher, changes chan<- time.Time) {
+// resolveSymlinks returns ps with symlinks resolved,
+// so that watches and the paths of events, matched by -x and the like,
+// are consistently beneath the real paths.
+func resolveSymlinks(ps []string) []string {
+	var rs []string
+	for _, p := range ps {
+		r, err := filepath.EvalSymlinks(p)
+		switch {
+		case err != nil:
+			// Reported when it is watched.
+			r = p
+		case r != path.Clean(p):
+			debugPrint("Watching %s as %s", p, r)
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+var (
+	watchErrorsMu sync.Mutex
+	// watchErrors is the watcher errors since the last run.
+	watchErrors []string
+)
+
+func addWatchError(err error) {
+	watchErrorsMu.Lock()
+	defer watchErrorsMu.Unlock()
+	watchErrors = append(watchErrors, err.Error())
+}
+
+// takeWatchErrors returns and clears the watcher errors since the last run.
+func takeWatchErrors() []string {
+	watchErrorsMu.Lock()
+	defer watchErrorsMu.Unlock()
+	errs := watchErrors
+	watchErrors = nil
+	return errs
+}
+
+// An eventFilter decides which file system events are changes.
+// Each of its functions returns why an event is skipped, or "" if it isn't,
+// and a nil function skips nothing.
+// listed is whether the event's path is listed by -from or -git,
+// and so watched regardless of most filters.
+type eventFilter struct {
+	// unwatched skips events for paths that aren't watched,
+	// such as excluded paths; created directories that it skips aren't watched.
+	unwatched func(ev fsnotify.Event, listed bool) string
+	// unchanged skips the remaining events that aren't changes,
+	// such as those for ignored files.
+	unchanged func(ev fsnotify.Event, listed bool) string
+}
+
+// flagFilter is the eventFilter given by the flags.
+var flagFilter = eventFilter{unwatched: skipUnwatched, unchanged: skipUnchanged}
+
+// skipUnwatched returns why ev is for a path that isn't watched, if it is.
+func skipUnwatched(ev fsnotify.Event, listed bool) string {
+	switch {
+	case isStatusFile(ev.Name):
+		return "it is the -status-file"
+	case *ignoreChmod && ev.Op == fsnotify.Chmod:
+		// Editors may bundle Chmod with Write,
+		// so only pure Chmod events are ignored.
+		return "it only changes attributes (-ignore-chmod)"
+	case !listed && excluded(ev.Name):
+		return "it is excluded (-x or -glob)"
+	}
+	if *useGitignore && !listed {
+		if isdir, _ := isDir(ev.Name); gitignored(ev.Name, isdir) {
+			return "it is gitignored"
+		}
+	}
+	return ""
+}
+
+// skipUnchanged returns why ev isn't a change that triggers a run, if it isn't.
+func skipUnchanged(ev fsnotify.Event, listed bool) string {
+	switch {
+	case *writesOnly && ev.Op&fsnotify.Write == 0:
+		return "it is not a write (-writes-only)"
+	case !listed && ignored(ev.Name):
+		return "it is ignored (-ignore, -only, hidden, or an editor temporary file)"
+	case !listed && includeRe != nil && !matches(includeRe, ev.Name):
+		return "it is not included (-i)"
+	case !listed && !isWatchedFor(ev.Name):
+		return "it doesn't match -watch-for"
+	case !listed && !hasExtension(ev.Name):
+		return "it has the wrong extension (-e)"
+	case ignoreCreation(ev):
+		return "it is newly created (-ignore-create)"
+	case *checksum && !contentChanged(path.Clean(ev.Name)):
+		return "its contents are unchanged (-checksum)"
+	}
+	return ""
+}
+
+// maxPending is the maximum number of changes queued by sendChanges.
+const maxPending = 10000
+
+// watchedFiles is the set of watched paths that are files, not directories.
+var watchedFiles = make(map[string]bool)
+
+// sendChanges sends the changes from the events of w that aren't skipped by f,
+// watching directories as they are created.
+func sendChanges(w fileWatcher, f eventFilter, changes chan<- change) {
+	// rewatch receives watched files that were replaced,
+	// once they exist again.
+	rewatch := make(chan string)
+	// pending queues changes while main is busy running the command,
+	// so that the watcher keeps reading events instead of blocking.
+	var pending []change
+	// synthetic queues events for files found in new directories,
+	// which may have been created before the directory was watched.
+	var synthetic []fsnotify.Event
 	for {
+		var out chan<- change
+		var next change
+		if len(pending) > 0 {
+			out, next = changes, pending[0]
+		}
+		var synthReady chan struct{}
+		if len(synthetic) > 0 {
+			synthReady = closed
+		}
+		var ev fsnotify.Event
 		select {
-		case err := <-w.Errors:
-			log.Fatalf("Watcher error: %s\n", err)
+		case out <- next:
+			pending = pending[1:]
+			continue
+
+		case err, ok := <-w.Errors():
+			if !ok {
+				log.Fatalln("Watcher closed")
+			}
+			log.Printf("Watcher error: %s\n", err)
+			addWatchError(err)
+			continue
 
-		case ev := <-w.Events:
-			if excludeRe != nil && excludeRe.MatchString(ev.Name) {
-				debugPrint("ignoring event for excluded %s", ev.Name)
+		case p := <-rewatch:
+			if isdir, _ := isDir(p); isdir {
+				debugPrint("%s was recreated", p)
+				watchDir(w, p, 0)
+				synthetic = append(synthetic, createdFiles(p)...)
 				continue
 			}
-			time, err := modTime(ev.Name)
-			if err != nil {
-				log.Printf("Failed to get even time: %s", err)
+			watch(w, p)
+			if isListFile(p) {
+				watchList(w)
+			}
+			continue
+
+		case <-reloadChan:
+			if err := reloadFilters(); err != nil {
+				log.Println("Failed to reload the filters:", err)
+				continue
+			}
+			log.Println("Reloaded the filters")
+			if *from == "" && !*gitMode {
+				rewalk(w)
+			}
+			continue
+
+		case e, ok := <-w.Events():
+			if !ok {
+				log.Fatalln("Watcher closed")
+			}
+			ev = e
+
+		case <-synthReady:
+			ev, synthetic = synthetic[0], synthetic[1:]
+		}
+		if ev.Name == "" {
+			// fsnotify may send events without a name
+			// for watches that were removed by unwatchDir.
+			skipEvent(ev, "it has no name")
+			continue
+		}
+		// Listed paths are watched regardless of filters.
+		isListed := listed[path.Clean(ev.Name)] || isListFile(ev.Name)
+		if isListFile(ev.Name) && ev.Op&fsnotify.Write != 0 {
+			watchList(w)
+		}
+		if f.unwatched != nil {
+			if why := f.unwatched(ev, isListed); why != "" {
+				skipEvent(ev, why)
 				continue
 			}
+		}
+		if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			if _, ok := dirDepths[path.Clean(ev.Name)]; ok && isRoot(ev.Name) {
+				log.Printf("%s was removed, waiting for it to be recreated", ev.Name)
+				go waitToExist(path.Clean(ev.Name), rewatch)
+			}
+			unwatchDir(w, ev.Name)
+			if p := path.Clean(ev.Name); watchedFiles[p] {
+				// Editors often save by renaming a new file
+				// over the old one, which removes the watch.
+				w.Remove(p)
+				removeWatched(p)
+				go waitToExist(p, rewatch)
+			}
+		}
+		if ev.Op&fsnotify.Create != 0 {
+			switch isdir, err := isDir(ev.Name); {
+			case err != nil:
+				log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
+				continue
 
-			debugPrint("%s at %s", ev, time)
+			case isdir && pruned(ev.Name):
+				debugPrint("Not watching pruned %s", ev.Name)
 
-			if ev.Op&fsnotify.Create != 0 {
-				switch isdir, err := isDir(ev.Name); {
-				case err != nil:
-					log.Printf("Couldn't check if %s is a directory: %s", ev.Name, err)
-					continue
+			case isdir && !*followSymlinks && isSymlink(ev.Name):
+				debugPrint("Not following symlink %s", ev.Name)
 
-				case isdir:
-					watchDir(w, ev.Name)
+			case isdir:
+				d := dirDepths[path.Dir(path.Clean(ev.Name))] + 1
+				if *maxDepth >= 0 && d > *maxDepth {
+					debugPrint("Not watching %s, it is too deep", ev.Name)
+					break
 				}
+				watchDir(w, ev.Name, d)
+				synthetic = append(synthetic, createdFiles(ev.Name)...)
+			}
+		}
+
+		if f.unchanged != nil {
+			if why := f.unchanged(ev, isListed); why != "" {
+				skipEvent(ev, why)
+				continue
+			}
+		}
+		var mtime time.Time
+		if ev.Op&fsnotify.Remove != 0 {
+			// modTime would be that of the directory.
+			mtime = time.Now()
+		} else {
+			var err error
+			if mtime, err = modTime(ev.Name); err != nil {
+				log.Printf("Failed to get even time: %s", err)
+				continue
 			}
+		}
+		if *listEvents {
+			log.Printf("event %s %s: triggers a rerun, modified at %s", ev.Op, ev.Name, mtime)
+		} else {
+			debugPrint("%s at %s", ev, mtime)
+		}
+		if *dryRun {
+			log.Printf("Would rerun for %s at %s", ev, mtime)
+		}
+
+		if len(pending) == maxPending {
+			debugPrint("Too many pending changes, dropping %s", pending[0].path)
+			pending = pending[1:]
+		}
+		pending = append(pending, change{path: ev.Name, time: mtime, op: ev.Op})
 
-			changes <- time
+	}
+}
+
+// closed is a closed channel, which is always ready to receive.
+var closed = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// createdFiles returns Create events for the files in the new,
+// now watched, directory p and its watched subdirectories.
+// Files created before the directory was watched have no events.
+func createdFiles(p string) []fsnotify.Event {
+	var evs []fsnotify.Event
+	p = path.Clean(p)
+	for d := range dirDepths {
+		if d != p && !strings.HasPrefix(d, p+"/") {
+			continue
+		}
+		ents, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
 		}
+		for _, e := range ents {
+			if !e.IsDir() {
+				debugPrint("Found %s in new directory %s", path.Join(d, e.Name()), p)
+				evs = append(evs, fsnotify.Event{Name: path.Join(d, e.Name()), Op: fsnotify.Create})
+			}
+		}
+	}
+	return evs
+}
+
+// skipEvent logs that ev does not trigger a rerun, and why,
+// with -list-events or -v.
+func skipEvent(ev fsnotify.Event, why string) {
+	if *listEvents {
+		log.Printf("event %s %s: ignored, %s", ev.Op, ev.Name, why)
+	} else {
+		debugPrint("ignoring event for %s, %s", ev.Name, why)
 	}
 }
 
@@ -258,43 +1824,197 @@ func modTime(p string) (time.Time, error) {
 	}
 }
 
-func watchDir(w *fsnotify.Watcher, p string) {
+// dirDepths maps each watched directory to its depth
+// beneath the watched path containing it.
+var dirDepths = make(map[string]int)
+
+// watchDir watches the directory p, at the given depth,
+// and its subdirectories down to the -depth.
+// If includeRe is set, subdirectories are only watched
+// if they contain an included file somewhere beneath them.
+func watchDir(w fileWatcher, p string, depth int) {
+	if !watchTree(w, p, depth) {
+		watch(w, p)
+	}
+}
+
+// walking is the set of resolved, absolute paths of the directories
+// currently being walked by watchTree, used to detect symlink loops.
+var walking = make(map[string]bool)
+
+// watchTree watches p and its subdirectories,
+// skipping any that contain no included files.
+// It returns whether p was watched.
+func watchTree(w fileWatcher, p string, depth int) bool {
+	real := realPath(p)
+	if walking[real] {
+		debugPrint("Not watching %s, it is a symlink loop to %s", p, real)
+		return false
+	}
+	walking[real] = true
+	defer delete(walking, real)
+
+	dirDepths[path.Clean(p)] = depth
 	ents, err := ioutil.ReadDir(p)
 	switch {
 	case os.IsNotExist(err):
-		return
+		return false
 
 	case err != nil:
 		log.Printf("Failed to watch %s: %s", p, err)
 	}
 
+	loadGitignore(p)
+	inc := includeRe == nil
 	for _, e := range ents {
 		sub := path.Join(p, e.Name())
-		if excludeRe != nil && excludeRe.MatchString(sub) {
+		if pruned(sub) {
 			debugPrint("excluding %s", sub)
 			continue
 		}
-		switch isdir, err := isDir(sub); {
-		case err != nil:
+		isdir, err := isDir(sub)
+		if err != nil {
 			log.Printf("Failed to watch %s: %s", sub, err)
+			continue
+		}
+		if gitignored(sub, isdir) {
+			debugPrint("excluding gitignored %s", sub)
+			continue
+		}
+		if isdir && !*followSymlinks && isSymlink(sub) {
+			debugPrint("Not following symlink %s", sub)
+			continue
+		}
+		switch {
+		case isdir && *maxDepth >= 0 && depth >= *maxDepth:
+			debugPrint("Not watching %s, it is too deep", sub)
 
 		case isdir:
-			watchDir(w, sub)
+			if watchTree(w, sub, depth+1) {
+				inc = true
+			}
+
+		case matches(includeRe, sub):
+			inc = true
 		}
 	}
 
+	if !inc {
+		debugPrint("Not watching %s, it contains no included files", p)
+		return false
+	}
 	watch(w, p)
+	return true
 }
 
-func watch(w *fsnotify.Watcher, p string) {
+// failedWatches is the number of paths that could not be watched.
+var failedWatches int
+
+func watch(w fileWatcher, p string) {
 	debugPrint("Watching %s", p)
 
 	switch err := w.Add(p); {
+	case err == nil:
+		addWatched(p)
+
 	case os.IsNotExist(err):
 		debugPrint("%s no longer exists", p)
 
+	case errors.Is(err, syscall.ENOSPC):
+		if failedWatches == 0 {
+			log.Printf("Failed to watch %s: the limit on the number of watches was reached.\n"+
+				"Consider excluding more paths or raising the limit with\n"+
+				"\tsysctl fs.inotify.max_user_watches=524288", p)
+		}
+		failedWatches++
+
 	case err != nil:
 		log.Printf("Failed to watch %s: %s", p, err)
+		failedWatches++
+	}
+}
+
+// creating maps files matching ignoreCreateRe that are being created
+// to the time of their most recent event.
+var creating = make(map[string]time.Time)
+
+// ignoreCreation returns whether ev is part of the creation
+// of a file matching ignoreCreateRe: the Create event itself,
+// or an event following it with no pause longer than the -d delay.
+func ignoreCreation(ev fsnotify.Event) bool {
+	if !matches(ignoreCreateRe, ev.Name) {
+		return false
+	}
+	quiet := *delay
+	if quiet == 0 {
+		quiet = rebuildDelay
+	}
+	now := time.Now()
+	if ev.Op&fsnotify.Create != 0 {
+		creating[ev.Name] = now
+		return true
+	}
+	last, ok := creating[ev.Name]
+	if !ok {
+		return false
+	}
+	if now.Sub(last) > quiet || ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		delete(creating, ev.Name)
+		return false
+	}
+	creating[ev.Name] = now
+	return true
+}
+
+// waitToExist sends p on c once it exists.
+func waitToExist(p string, c chan<- string) {
+	for {
+		if _, err := os.Stat(p); err == nil {
+			c <- p
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// unwatchDir stops watching the directory p and its subdirectories,
+// if they are watched, and forgets their state.
+// It is called when p is removed or renamed, so that the watches
+// are re-established with the correct paths if it reappears.
+func unwatchDir(w fileWatcher, p string) {
+	p = path.Clean(p)
+	for d := range dirDepths {
+		if d != p && !strings.HasPrefix(d, p+"/") {
+			continue
+		}
+		debugPrint("Unwatching %s", d)
+		// The watch may already be gone if d was removed.
+		w.Remove(d)
+		removeWatched(d)
+		delete(dirDepths, d)
+		delete(gitignores, d)
+	}
+}
+
+// reloadChan receives requests to reload the filters from the config file.
+var reloadChan = make(chan struct{}, 1)
+
+// reload requests that the filters be reloaded from the config file.
+func reload() {
+	select {
+	case reloadChan <- struct{}{}:
+	default:
+		debugPrint("Reload already pending")
+	}
+}
+
+// rewalk re-watches the watched directories with the current filters.
+func rewalk(w fileWatcher) {
+	for _, r := range watchRoots {
+		if isdir, _ := isDir(r); isdir {
+			unwatchDir(w, r)
+			watchDir(w, r, 0)
+		}
 	}
 }
 
@@ -309,6 +2029,40 @@ func isDir(p string) (bool, error) {
 	}
 }
 
+// appendPath returns ps with p moved or appended to the end.
+func appendPath(ps []string, p string) []string {
+	for i, q := range ps {
+		if q == p {
+			ps = append(ps[:i], ps[i+1:]...)
+			break
+		}
+	}
+	return append(ps, p)
+}
+
+func isTerminal(f *os.File) bool {
+	s, err := f.Stat()
+	return err == nil && s.Mode()&os.ModeCharDevice != 0
+}
+
+func isSymlink(p string) bool {
+	s, err := os.Lstat(p)
+	return err == nil && s.Mode()&os.ModeSymlink != 0
+}
+
+// realPath returns the absolute path of p with symlinks resolved,
+// or p itself if it cannot be resolved.
+func realPath(p string) string {
+	r, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return p
+	}
+	if r, err = filepath.Abs(r); err != nil {
+		return p
+	}
+	return r
+}
+
 func debugPrint(f string, vals ...interface{}) {
 	if *debug {
 		log.Printf("DEBUG: "+f, vals...)
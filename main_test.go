@@ -0,0 +1,204 @@
+package main
+
+import (
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// A fakeProcess records the signals sent to it by a killer,
+// exiting when it is sent exitOn or SIGKILL.
+type fakeProcess struct {
+	mu     sync.Mutex
+	sigs   []syscall.Signal
+	exitOn syscall.Signal
+	done   chan struct{}
+}
+
+func (p *fakeProcess) signal(sig syscall.Signal) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sigs = append(p.sigs, sig)
+	if sig == p.exitOn || sig == syscall.SIGKILL {
+		select {
+		case <-p.done:
+		default:
+			close(p.done)
+		}
+	}
+}
+
+func TestKiller(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		killTimeout time.Duration
+		// kills is the number of kills sent.
+		kills int
+		// exitOn is the signal on which the process exits;
+		// 0 means it has already exited.
+		exitOn       syscall.Signal
+		wantSigs     []syscall.Signal
+		wantTimedOut bool
+		wantKilled   bool
+	}{
+		{
+			name:   "exited",
+			exitOn: 0,
+		},
+		{
+			name:       "exits on term",
+			kills:      1,
+			exitOn:     termSignal,
+			wantSigs:   []syscall.Signal{termSignal},
+			wantKilled: true,
+		},
+		{
+			name:       "second kill",
+			kills:      2,
+			exitOn:     syscall.SIGKILL,
+			wantSigs:   []syscall.Signal{termSignal, syscall.SIGKILL},
+			wantKilled: true,
+		},
+		{
+			name:        "kill timeout",
+			killTimeout: 10 * time.Millisecond,
+			kills:       1,
+			exitOn:      syscall.SIGKILL,
+			wantSigs:    []syscall.Signal{termSignal, syscall.SIGKILL},
+			wantKilled:  true,
+		},
+		{
+			name:         "timeout",
+			timeout:      10 * time.Millisecond,
+			exitOn:       termSignal,
+			wantSigs:     []syscall.Signal{termSignal},
+			wantTimedOut: true,
+			wantKilled:   true,
+		},
+		{
+			name:         "timeout and kill timeout",
+			timeout:      10 * time.Millisecond,
+			killTimeout:  10 * time.Millisecond,
+			exitOn:       syscall.SIGKILL,
+			wantSigs:     []syscall.Signal{termSignal, syscall.SIGKILL},
+			wantTimedOut: true,
+			wantKilled:   true,
+		},
+	}
+	for _, test := range tests {
+		p := &fakeProcess{exitOn: test.exitOn, done: make(chan struct{})}
+		if test.exitOn == 0 {
+			close(p.done)
+		}
+		k := killer{
+			signal:      p.signal,
+			reap:        func() {},
+			timeout:     test.timeout,
+			killTimeout: test.killTimeout,
+		}
+		kills := make(chan struct{})
+		type result struct{ timedOut, killed bool }
+		res := make(chan result)
+		go func() {
+			timedOut, killed := k.wait(time.Now(), p.done, kills)
+			res <- result{timedOut, killed}
+		}()
+		for i := 0; i < test.kills; i++ {
+			kills <- struct{}{}
+		}
+		var r result
+		select {
+		case r = <-res:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: wait didn't return", test.name)
+		}
+		if r.timedOut != test.wantTimedOut || r.killed != test.wantKilled {
+			t.Errorf("%s: wait()=%v, %v, want %v, %v", test.name, r.timedOut, r.killed, test.wantTimedOut, test.wantKilled)
+		}
+		if !reflect.DeepEqual(p.sigs, test.wantSigs) {
+			t.Errorf("%s: signals %v, want %v", test.name, p.sigs, test.wantSigs)
+		}
+	}
+}
+
+func TestExcludedGlob(t *testing.T) {
+	defer func(globs, roots []string) { excludeGlobs, watchRoots = globs, roots }(excludeGlobs, watchRoots)
+	watchRoots = []string{"."}
+	tests := []struct {
+		glob string
+		path string
+		want bool
+	}{
+		{"*.o", "a.o", true},
+		{"*.o", "x/y/a.o", true},
+		{"build/*", "build/a", true},
+		{"build/*", "x/build/a", false},
+		{"**/testdata/*", "testdata/x", true},
+		{"**/testdata/*", "a/testdata/x", true},
+		{"**/testdata/*", "a/b/testdata/x", true},
+		{"**/testdata/*", "a/testdata", false},
+		{"**/testdata/*", "a/testdata/x/y", false},
+		{"**/*.tmp", "a/b/c.tmp", true},
+	}
+	for _, test := range tests {
+		excludeGlobs = []string{test.glob}
+		if got := excluded(test.path); got != test.want {
+			t.Errorf("excluded(%q) with -glob %q = %v, want %v", test.path, test.glob, got, test.want)
+		}
+	}
+}
+
+func TestMapJobs(t *testing.T) {
+	defer func(args []string, exts extMap) { commandArgs, extCommands = args, exts }(commandArgs, extCommands)
+	commandArgs = []string{"golint", "{}"}
+	extCommands = extMap{".md": {"make", "docs", "{}"}}
+	tests := []struct {
+		name    string
+		paths   []string
+		changed string
+		want    []job
+	}{
+		{
+			name: "no changes",
+			want: []job{{name: "default", stages: [][]string{{"golint"}}}},
+		},
+		{
+			name:    "unmapped",
+			paths:   []string{"a.go", "b.go"},
+			changed: "b.go",
+			want:    []job{{name: "default", stages: [][]string{{"golint", "b.go"}}}},
+		},
+		{
+			name:    "mapped",
+			paths:   []string{"a.md"},
+			changed: "a.md",
+			want:    []job{{name: ".md", stages: [][]string{{"make", "docs", "a.md"}}}},
+		},
+		{
+			name:    "mapped newest",
+			paths:   []string{"foo.go", "README.md"},
+			changed: "README.md",
+			want: []job{
+				{name: "default", stages: [][]string{{"golint", "foo.go"}}},
+				{name: ".md", stages: [][]string{{"make", "docs", "README.md"}}},
+			},
+		},
+		{
+			name:    "unmapped newest",
+			paths:   []string{"README.md", "foo.go", "x.md"},
+			changed: "x.md",
+			want: []job{
+				{name: "default", stages: [][]string{{"golint", "foo.go"}}},
+				{name: ".md", stages: [][]string{{"make", "docs", "x.md"}}},
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := mapJobs(test.paths, test.changed); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: mapJobs(%q, %q)=%v, want %v", test.name, test.paths, test.changed, got, test.want)
+		}
+	}
+}
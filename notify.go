@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// failing is whether the most recent run exited with a non-zero status.
+var failing bool
+
+// notifyStatus sends a desktop notification if status differs
+// in success or failure from that of the previous run.
+// line is the first line of the command's standard error.
+func notifyStatus(status int, line string) {
+	switch {
+	case status != 0 && !failing:
+		notify("exit status "+strconv.Itoa(status), line)
+	case status == 0 && failing:
+		notify("passing", "")
+	}
+	failing = status != 0
+}
+
+// notify sends a desktop notification using notify-send or osascript,
+// whichever is available.
+func notify(title, body string) {
+	title = "Watch: " + title
+	var cmd *exec.Cmd
+	if _, err := exec.LookPath("notify-send"); err == nil {
+		cmd = exec.Command("notify-send", title, body)
+	} else if _, err := exec.LookPath("osascript"); err == nil {
+		script := fmt.Sprintf("display notification %q with title %q", body, title)
+		cmd = exec.Command("osascript", "-e", script)
+	} else {
+		debugPrint("No notify-send or osascript, not notifying")
+		return
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		log.Printf("Failed to send notification: %s: %s", err, out)
+	}
+}
+
+// A syncWriter serializes writes to an io.Writer
+// shared with other syncWriters using the same Mutex.
+type syncWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (s syncWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(data)
+}
+
+// A firstLineWriter passes writes through to an io.Writer,
+// recording the first line written.
+type firstLineWriter struct {
+	io.Writer
+	line []byte
+	done bool
+}
+
+func (f *firstLineWriter) Write(data []byte) (int, error) {
+	if !f.done {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			f.line = append(f.line, data[:i]...)
+			f.done = true
+		} else {
+			f.line = append(f.line, data...)
+		}
+	}
+	return f.Writer.Write(data)
+}
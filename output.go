@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"strconv"
+)
+
+// maxQuietOutput is the maximum number of bytes of output
+// buffered for a run with -q.
+const maxQuietOutput = 1 << 20
+
+// A tailBuffer is an io.Writer that keeps the last max bytes written.
+type tailBuffer struct {
+	max     int
+	buf     []byte
+	dropped int
+}
+
+func (t *tailBuffer) Write(data []byte) (int, error) {
+	t.buf = append(t.buf, data...)
+	// Trimming only once buf is twice max amortizes the copying.
+	if len(t.buf) > 2*t.max {
+		t.trim()
+	}
+	return len(data), nil
+}
+
+func (t *tailBuffer) trim() {
+	if n := len(t.buf) - t.max; n > 0 {
+		t.buf = append(t.buf[:0], t.buf[n:]...)
+		t.dropped += n
+	}
+}
+
+// Bytes returns the last max bytes written.
+func (t *tailBuffer) Bytes() []byte {
+	t.trim()
+	return t.buf
+}
+
+// A limitWriter is an io.Writer that writes at most max bytes to w,
+// followed by a note that the output was truncated.
+// Writes past max are discarded but reported as successful,
+// so that the command is not blocked writing to a full pipe.
+type limitWriter struct {
+	w       io.Writer
+	max     int
+	n       int
+	newline bool
+}
+
+func (l *limitWriter) Write(data []byte) (int, error) {
+	if l.n >= l.max {
+		return len(data), nil
+	}
+	d := data
+	if len(d) > l.max-l.n {
+		d = d[:l.max-l.n]
+	}
+	m, err := l.w.Write(d)
+	l.n += m
+	if m > 0 {
+		l.newline = d[m-1] == '\n'
+	}
+	if err != nil {
+		return m, err
+	}
+	if l.n >= l.max {
+		msg := "... output truncated at " + strconv.Itoa(l.max) + " bytes\n"
+		if !l.newline {
+			msg = "\n" + msg
+		}
+		io.WriteString(l.w, msg)
+	}
+	return len(data), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+// A parallelRun is a run started with -parallel.
+type parallelRun struct {
+	info   runInfo
+	done   chan struct{}
+	status int
+	out    bytes.Buffer
+}
+
+// A bufferUI is a ui that writes to a buffer, for runs with -parallel.
+type bufferUI struct{ *bytes.Buffer }
+
+func (b bufferUI) redisplay(r runInfo) { r.write(b) }
+
+func (b bufferUI) rerun() <-chan string { return nil }
+
+// A parallelRunner runs jobs in the background, for -parallel.
+// The output of each run is displayed on the ui once it
+// and all of the runs started before it have finished.
+type parallelRunner struct {
+	ui ui
+	// run runs the jobs, as for a Watcher.
+	run func(ui ui, jobs []job, reason string, events int, trigger, deleted []string) (time.Time, int)
+	// runs is the started runs in the order they started.
+	runs chan *parallelRun
+	// sem limits the number of runs running at once.
+	sem chan struct{}
+}
+
+// newParallelRunner returns a parallelRunner that runs
+// at most n runs at once with run, displaying them on ui.
+// If maxRuns is positive, exit is called with the status
+// of the last run once maxRuns runs have been displayed.
+func newParallelRunner(ui ui, n, maxRuns int, run func(ui, []job, string, int, []string, []string) (time.Time, int), exit func(int)) *parallelRunner {
+	p := &parallelRunner{
+		ui:   ui,
+		run:  run,
+		runs: make(chan *parallelRun, maxPending),
+		sem:  make(chan struct{}, n),
+	}
+	go p.display(maxRuns, exit)
+	return p
+}
+
+// start runs the jobs in the background,
+// once fewer than the limit of runs are running.
+func (p *parallelRunner) start(jobs []job, reason string, events int, trigger, deleted []string) {
+	r := &parallelRun{
+		info: runInfo{
+			command: commandString(jobs),
+			start:   time.Now(),
+			reason:  reason,
+			trigger: trigger,
+		},
+		done: make(chan struct{}),
+	}
+	p.runs <- r
+	go func() {
+		p.sem <- struct{}{}
+		_, r.status = p.run(bufferUI{&r.out}, jobs, reason, events, trigger, deleted)
+		<-p.sem
+		close(r.done)
+	}()
+}
+
+// display displays the output of the runs
+// in the order they started as they finish.
+func (p *parallelRunner) display(maxRuns int, exit func(int)) {
+	var n int
+	for r := range p.runs {
+		<-r.done
+		r.info.write = func(out io.Writer) int {
+			out.Write(r.out.Bytes())
+			return r.status
+		}
+		p.ui.redisplay(r.info)
+		if s, ok := p.ui.(statusUI); ok {
+			s.setStatus(r.status)
+		}
+		n++
+		if maxRuns > 0 && n >= maxRuns {
+			exit(r.status)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path"
+	"time"
+)
+
+// pollChanges sends on changes whenever the newest modification time
+// of the files and directories beneath ps advances,
+// checking once every interval.
+func pollChanges(ps []string, interval time.Duration, changes chan<- change) {
+	last := newest(ps)
+	tick := time.Tick(interval)
+	for {
+		select {
+		case <-tick:
+		case <-reloadChan:
+			if err := reloadFilters(); err != nil {
+				log.Println("Failed to reload the filters:", err)
+			} else {
+				log.Println("Reloaded the filters")
+			}
+			continue
+		}
+		if c := newest(ps); c.time.After(last.time) {
+			debugPrint("Polled change to %s at %s", c.path, c.time)
+			if *dryRun {
+				log.Printf("Would rerun for %s at %s", c.path, c.time)
+			}
+			last = c
+			changes <- c
+		}
+	}
+}
+
+func newest(ps []string) change {
+	var c change
+	for _, p := range ps {
+		if d := newestModTime(p, 0); d.time.After(c.time) {
+			c = d
+		}
+	}
+	return c
+}
+
+// newestModTime returns the newest change to p, at the given depth, and,
+// if it is a directory, of anything beneath it that is not excluded.
+// Directory modification times are ignored when includeRe, extensions,
+// or watchForGlobs are set, since they change for files that are not included,
+// and for directories containing the -only directories.
+func newestModTime(p string, depth int) change {
+	isdir, err := isDir(p)
+	if err != nil {
+		log.Printf("Failed to poll %s: %s", p, err)
+		return change{}
+	}
+	c := change{path: p}
+	if inOnly(p) && (includeRe == nil && extensions == nil && watchForGlobs == nil || !isdir && (includeRe == nil || matches(includeRe, p)) && hasExtension(p) && isWatchedFor(p)) {
+		if c.time, err = modTime(p); err != nil {
+			log.Printf("Failed to poll %s: %s", p, err)
+		}
+	}
+	if !isdir {
+		return c
+	}
+	real := realPath(p)
+	if walking[real] {
+		return c
+	}
+	walking[real] = true
+	defer delete(walking, real)
+
+	ents, err := ioutil.ReadDir(p)
+	if err != nil {
+		log.Printf("Failed to poll %s: %s", p, err)
+		return c
+	}
+	loadGitignore(p)
+	for _, e := range ents {
+		sub := path.Join(p, e.Name())
+		isdir, _ := isDir(sub)
+		if isdir && pruned(sub) || !isdir && (ignored(sub) || isStatusFile(sub)) || gitignored(sub, isdir) ||
+			isdir && *maxDepth >= 0 && depth >= *maxDepth || isdir && !*followSymlinks && isSymlink(sub) {
+			continue
+		}
+		if d := newestModTime(sub, depth+1); d.time.After(c.time) {
+			c = d
+		}
+	}
+	return c
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// openPty returns the master and slave of a new pseudo-terminal.
+func openPty() (*os.File, *os.File, error) {
+	ptm, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var n uint32
+	if err := ioctl(ptm, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	var unlock int32
+	if err := ioctl(ptm, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	ws := struct{ row, col, x, y uint16 }{24, 80, 0, 0}
+	if err := ioctl(ptm, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws))); err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	pts, err := os.OpenFile("/dev/pts/"+strconv.Itoa(int(n)), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptm.Close()
+		return nil, nil, err
+	}
+	// Don't translate newlines to carriage return, newline.
+	var t syscall.Termios
+	if err := ioctl(pts, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err == nil {
+		t.Oflag &^= syscall.ONLCR
+		ioctl(pts, syscall.TCSETS, uintptr(unsafe.Pointer(&t)))
+	}
+	return ptm, pts, nil
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, arg); e != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("ptys are only supported on Linux")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A rule is a section of the config file that runs its own command
+// for changes to the files beneath its paths.
+type rule struct {
+	name    string
+	paths   []string
+	exclude *regexp.Regexp
+	command []string
+}
+
+// rules is the rules read from the config file, in order.
+var rules []*rule
+
+// matches returns whether p is beneath one of the rule's paths
+// and not excluded by it.
+func (r *rule) matches(p string) bool {
+	p = path.Clean(p)
+	for _, q := range r.paths {
+		if p == q || q == "." || strings.HasPrefix(p, q+"/") {
+			return !matches(r.exclude, p)
+		}
+	}
+	return false
+}
+
+// rulePaths returns the paths of all of the rules.
+func rulePaths() []string {
+	var ps []string
+	for _, r := range rules {
+		ps = append(ps, r.paths...)
+	}
+	return ps
+}
+
+// setKey sets the rule's key to val, from the config file.
+func (r *rule) setKey(key, val string) error {
+	switch key {
+	case "path", "p":
+		r.paths = append(r.paths, path.Clean(val))
+	case "exclude", "x":
+		re, err := compileRegexp(val)
+		if err != nil {
+			return err
+		}
+		r.exclude = re
+	case "command":
+		r.command = strings.Fields(val)
+	default:
+		return errors.New("unknown rule key " + key)
+	}
+	return nil
+}
+
+// ruleJobs returns the jobs to run for changes to paths
+// when there are rules.
+//
+// The command of each rule matching any of the changed paths
+// is run once, as its own job, in the order of the rules, with placeholder replaced
+// by the most recently changed path that it matches.
+// Changed paths matching no rule are handled as if there were no rules,
+// and their jobs are run first.
+// If there are no changed paths, every command is run.
+func ruleJobs(paths []string, changed string) []job {
+	newest := make([]string, len(rules))
+	var rest []string
+	for _, p := range paths {
+		matched := false
+		for i, r := range rules {
+			if r.matches(p) {
+				newest[i], matched = p, true
+			}
+		}
+		if !matched {
+			rest = append(rest, p)
+		}
+	}
+	var jobs []job
+	if len(paths) == 0 {
+		jobs = mapJobs(nil, changed)
+	} else if len(rest) > 0 {
+		jobs = mapJobs(rest, rest[len(rest)-1])
+	}
+	for i, r := range rules {
+		if len(paths) == 0 || newest[i] != "" {
+			jobs = appendJob(jobs, r.name, split(r.command, newest[i]))
+		}
+	}
+	return jobs
+}
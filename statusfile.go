@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// writeStatusFile writes the exit status, end time, and duration of a run
+// to the -status-file as JSON, replacing it atomically,
+// so that a reader never sees a partial write.
+func writeStatusFile(status int, start time.Time) error {
+	end := time.Now()
+	data, err := json.Marshal(struct {
+		Status   int     `json:"status"`
+		Time     string  `json:"time"`
+		Duration float64 `json:"duration"`
+	}{status, end.Format(time.RFC3339), end.Sub(start).Seconds()})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(*statusFile), filepath.Base(*statusFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), *statusFile); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// isStatusFile returns whether p is the -status-file
+// or one of the temporary files written while replacing it,
+// whose changes must not trigger a rerun.
+func isStatusFile(p string) bool {
+	if *statusFile == "" {
+		return false
+	}
+	a, err := filepath.Abs(p)
+	if err != nil {
+		return false
+	}
+	s, err := filepath.Abs(*statusFile)
+	if err != nil {
+		return false
+	}
+	return a == s || filepath.Dir(a) == filepath.Dir(s) &&
+		strings.HasPrefix(filepath.Base(a), filepath.Base(s)+".tmp")
+}
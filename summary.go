@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	summaryMu sync.Mutex
+	// passed and failed are the number of runs that passed and failed.
+	passed, failed int
+	// runTime is the total time spent running the command.
+	runTime time.Duration
+)
+
+// recordRun adds a run with the given exit status and duration to the summary.
+func recordRun(status int, d time.Duration) {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	if status == 0 {
+		passed++
+	} else {
+		failed++
+	}
+	runTime += d
+}
+
+// writeSummary writes the number of runs that passed and failed
+// and the total time spent running to w.
+func writeSummary(w io.Writer) {
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	fmt.Fprintf(w, "%d runs: %d passed, %d failed, %s running\n",
+		passed+failed, passed, failed, runTime.Round(time.Millisecond))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"os"
+	"time"
+)
+
+// readTrigger returns a channel that receives for each line written to the FIFO at p.
+// The FIFO is created if it does not exist,
+// and it is reopened if it is removed and recreated.
+func readTrigger(p string) <-chan struct{} {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		if err := mkfifo(p); err != nil {
+			log.Fatalln("Failed to create the trigger FIFO:", err)
+		}
+	}
+	trig := make(chan struct{})
+	go func() {
+		for {
+			// Opening for writing too means that Open doesn't block
+			// waiting for a writer and reads never see end of file
+			// when a writer closes, so it can be written repeatedly.
+			f, err := os.OpenFile(p, os.O_RDWR, 0)
+			if err != nil {
+				debugPrint("Failed to open the trigger FIFO: %s", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			done := make(chan struct{})
+			go closeIfReplaced(p, f, done)
+			s := bufio.NewScanner(f)
+			for s.Scan() {
+				debugPrint("Triggered: %q", s.Text())
+				trig <- struct{}{}
+			}
+			close(done)
+			f.Close()
+		}
+	}()
+	return trig
+}
+
+// closeIfReplaced closes f once the file at p is no longer f,
+// or returns when done is closed.
+func closeIfReplaced(p string, f *os.File, done <-chan struct{}) {
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("Failed to stat the trigger FIFO: %s", err)
+		f.Close()
+		return
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick.C:
+		}
+		if cur, err := os.Stat(p); err != nil || !os.SameFile(fi, cur) {
+			debugPrint("Trigger FIFO %s was replaced", p)
+			f.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	watchedMu sync.Mutex
+	// watched is the set of paths registered with the watcher.
+	watched = make(map[string]bool)
+)
+
+func addWatched(p string) {
+	watchedMu.Lock()
+	watched[path.Clean(p)] = true
+	watchedMu.Unlock()
+}
+
+func removeWatched(p string) {
+	watchedMu.Lock()
+	delete(watched, path.Clean(p))
+	watchedMu.Unlock()
+}
+
+// writeWatched writes the sorted list of watched paths to w.
+func writeWatched(w io.Writer) {
+	watchedMu.Lock()
+	ps := make([]string, 0, len(watched))
+	for p := range watched {
+		ps = append(ps, p)
+	}
+	watchedMu.Unlock()
+
+	sort.Strings(ps)
+	io.WriteString(w, strconv.Itoa(len(ps))+" watched paths:\n")
+	for _, p := range ps {
+		io.WriteString(w, "\t"+p+"\n")
+	}
+}
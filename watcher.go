@@ -0,0 +1,297 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// A watchConfig is how a Watcher schedules runs, from the flags.
+type watchConfig struct {
+	// delaySuccess and delayFailure are how long to wait for changes
+	// to settle after a successful or a failed run; see -d.
+	delaySuccess, delayFailure time.Duration
+	// burst and burstMax grow the delay for bursts of events; see settleTime.
+	burst    int
+	burstMax time.Duration
+	// minInterval and backoff limit how often changes run the command.
+	minInterval, backoff time.Duration
+	// killEager stops the -restart command on the first change.
+	killEager bool
+	restart   bool
+	// parallel is the number of runs that may run at once.
+	parallel int
+	// maxRuns is the number of runs after which to exit; 0 means no limit.
+	maxRuns int
+	dryRun  bool
+	// onDelete is whether to record deleted paths, for -on-delete.
+	onDelete   bool
+	runAtStart bool
+}
+
+// flagConfig returns the watchConfig given by the flags.
+func flagConfig() watchConfig {
+	return watchConfig{
+		delaySuccess: *delaySuccess,
+		delayFailure: *delayFailure,
+		burst:        *burst,
+		burstMax:     *burstMax,
+		minInterval:  *minInterval,
+		backoff:      *backoff,
+		killEager:    *killEager,
+		restart:      *restart,
+		parallel:     *parallel,
+		maxRuns:      *maxRuns,
+		dryRun:       *dryRun,
+		onDelete:     *onDelete != "",
+		runAtStart:   *runAtStart,
+	}
+}
+
+// A Watcher decides when to run the command for the changes it receives.
+// The changes, its config, and how the command is run are given to it,
+// so that its debouncing and scheduling can be driven
+// without a file system watcher or real processes.
+type Watcher struct {
+	ui     ui
+	config watchConfig
+	// changes receives the changes that may trigger a run.
+	// The loop returns once it is closed.
+	changes <-chan change
+	// triggers receives a value for each -trigger line.
+	triggers <-chan struct{}
+	// jobs returns the jobs to run for the changed paths; see jobsFor.
+	jobs func(paths []string, changed string) []job
+	// run runs the jobs, displaying the output on the ui,
+	// and returns the time it finished and its exit status.
+	run func(ui ui, jobs []job, reason string, events int, trigger, deleted []string) (time.Time, int)
+	// stopServer stops the command started by -restart, if it is running.
+	stopServer func()
+	// exit exits Watch with the status of the last run, after -n runs.
+	exit func(status int)
+	// parallel runs the jobs with -parallel, once there has been a run.
+	parallel *parallelRunner
+
+	timer      *time.Timer
+	lastRun    time.Time
+	lastChange time.Time
+	changed    string
+	// pending is the distinct paths changed since the last run,
+	// ordered by their most recent change.
+	pending []string
+	// deleted is the distinct paths deleted since the last run, for -on-delete.
+	deleted []string
+	// events is the number of events since the last run, for -burst.
+	events int
+	runs   int
+	// lastStart is the time the most recent run started.
+	lastStart time.Time
+	// failures is the number of consecutive failed runs, for -backoff.
+	failures int
+	// timerReason is the reason for the run when the timer fires:
+	// "startup" until the first run, and empty for changes.
+	timerReason string
+}
+
+// newWatcher returns a Watcher that runs the command
+// for the changes and triggers, displaying the output on ui.
+func newWatcher(ui ui, config watchConfig, changes <-chan change, triggers <-chan struct{}) *Watcher {
+	w := &Watcher{
+		ui:         ui,
+		config:     config,
+		changes:    changes,
+		triggers:   triggers,
+		jobs:       jobsFor,
+		run:        run,
+		stopServer: stopServer,
+		exit: func(status int) {
+			writeSummary(os.Stderr)
+			os.Exit(status)
+		},
+		// The timer fires immediately, running the command
+		// if lastChange is after lastRun, so to run at startup,
+		// treat startup as a change.
+		timer: time.NewTimer(0),
+	}
+	if config.runAtStart {
+		w.lastChange = time.Now()
+		w.timerReason = "startup"
+	}
+	return w
+}
+
+// loop runs the command for changes, once they settle,
+// until the changes channel is closed.
+func (w *Watcher) loop() {
+	for {
+		select {
+		case c, ok := <-w.changes:
+			if !ok {
+				return
+			}
+			w.change(c)
+
+		case why := <-w.ui.rerun():
+			w.doRun(w.jobs(w.pending, w.changed), why)
+
+		case <-w.triggers:
+			w.doRun(w.jobs(w.pending, w.changed), "-trigger")
+
+		case <-w.timer.C:
+			if !w.lastRun.Before(w.lastChange) {
+				break
+			}
+			if wait := w.interval() - time.Since(w.lastStart); wait > 0 {
+				debugPrint("Deferring run for %s", wait)
+				w.timer.Reset(wait)
+				break
+			}
+			w.doRun(w.jobs(w.pending, w.changed), w.timerReason)
+		}
+	}
+}
+
+// change records the change c, and either runs the command
+// or sets the timer to run it once changes settle.
+func (w *Watcher) change(c change) {
+	w.lastChange, w.changed = c.time, c.path
+	if w.config.killEager && len(w.pending) == 0 {
+		w.stopServer()
+	}
+	w.pending = appendPath(w.pending, c.path)
+	if w.config.onDelete && c.op&fsnotify.Remove != 0 {
+		w.deleted = appendPath(w.deleted, c.path)
+	}
+	w.events++
+	d := w.config.delaySuccess
+	if w.failures > 0 {
+		d = w.config.delayFailure
+	}
+	if d > 0 {
+		w.timer.Reset(w.config.settleTime(w.events, d))
+		return
+	}
+	if wait := w.interval() - time.Since(w.lastStart); wait > 0 {
+		w.timer.Reset(wait)
+		return
+	}
+	w.doRun(w.jobs(w.pending, w.changed), "")
+}
+
+// interval returns the minimum time between runs.
+func (w *Watcher) interval() time.Duration {
+	if b := w.config.backoffTime(w.failures); b > w.config.minInterval {
+		return b
+	}
+	return w.config.minInterval
+}
+
+// backoffTime returns the minimum time between runs
+// after n consecutive failures, for -backoff.
+// It doubles with each failure after the first, from one second up to -backoff.
+func (c watchConfig) backoffTime(n int) time.Duration {
+	if c.backoff <= 0 || n < 2 {
+		return 0
+	}
+	d := time.Second
+	for i := 2; i < n && d < c.backoff; i++ {
+		d *= 2
+	}
+	if d > c.backoff {
+		d = c.backoff
+	}
+	return d
+}
+
+// settleTime returns how long to wait for changes to settle after n events.
+// This is the delay, unless there have been more than -burst events,
+// such as during a git checkout, in which case it grows with
+// the number of events, up to -burst-max.
+func (c watchConfig) settleTime(n int, delay time.Duration) time.Duration {
+	if c.burst <= 0 || n <= c.burst {
+		return delay
+	}
+	d := delay * time.Duration(n/c.burst)
+	if d > c.burstMax || d < 0 {
+		d = c.burstMax
+	}
+	if d < delay {
+		d = delay
+	}
+	debugPrint("%d events, waiting %s for changes to settle", n, d)
+	return d
+}
+
+// doRun runs the jobs for the pending changes.
+// reason is why it was run other than changes, if any.
+func (w *Watcher) doRun(jobs []job, reason string) {
+	events, trigger, removed := w.events, w.pending, w.deleted
+	w.pending, w.deleted = nil, nil
+	w.events = 0
+	// Whatever runs first is the run at startup.
+	w.timerReason = ""
+	if w.config.dryRun {
+		w.lastRun = time.Now()
+		return
+	}
+	if len(jobs) == 0 {
+		// The changes match no rule, and there is no default command.
+		debugPrint("No command to run")
+		w.lastRun = time.Now()
+		return
+	}
+	if w.config.restart {
+		w.stopServer()
+	}
+	w.lastStart = time.Now()
+	if w.config.parallel > 1 {
+		if w.config.maxRuns > 0 && w.runs >= w.config.maxRuns {
+			return
+		}
+		w.runs++
+		w.lastRun = w.lastStart
+		if w.parallel == nil {
+			w.parallel = newParallelRunner(w.ui, w.config.parallel, w.config.maxRuns, w.run, w.exit)
+		}
+		w.parallel.start(jobs, reason, events, trigger, removed)
+		return
+	}
+	var status int
+	w.lastRun, status = w.run(w.ui, jobs, reason, events, trigger, removed)
+	if status == 0 {
+		w.failures = 0
+	} else {
+		w.failures++
+	}
+	if s, ok := w.ui.(statusUI); ok {
+		s.setStatus(status)
+	}
+	w.runs++
+	if w.config.maxRuns > 0 && w.runs >= w.config.maxRuns {
+		w.exit(status)
+	}
+}
+
+// A fileWatcher reports file system events for the paths added to it.
+// sendChanges reads from a fileWatcher, instead of fsnotify directly,
+// so that it can be given events without a file system.
+type fileWatcher interface {
+	Add(p string) error
+	Remove(p string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// A notifyWatcher is a fileWatcher using fsnotify.
+type notifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func (n notifyWatcher) Add(p string) error { return n.w.Add(p) }
+
+func (n notifyWatcher) Remove(p string) error { return n.w.Remove(p) }
+
+func (n notifyWatcher) Events() <-chan fsnotify.Event { return n.w.Events }
+
+func (n notifyWatcher) Errors() <-chan error { return n.w.Errors }
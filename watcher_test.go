@@ -0,0 +1,305 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// A fakeUI is a ui that displays nothing and is never asked to rerun.
+type fakeUI struct{}
+
+func (fakeUI) redisplay(runInfo) {}
+
+func (fakeUI) rerun() <-chan string { return nil }
+
+// A fakeRun is a run of a Watcher's fake run function.
+type fakeRun struct {
+	reason  string
+	events  int
+	trigger []string
+	time    time.Time
+}
+
+// newTestWatcher returns a Watcher for the changes,
+// with a fake command, whose runs are sent on the returned channel,
+// and which exits with the next of statuses, or 0 once they are exhausted.
+func newTestWatcher(config watchConfig, changes <-chan change, statuses ...int) (*Watcher, <-chan fakeRun) {
+	runs := make(chan fakeRun, 100)
+	w := newWatcher(fakeUI{}, config, changes, nil)
+	w.jobs = func([]string, string) []job {
+		return []job{{name: "test", stages: [][]string{{"test"}}}}
+	}
+	w.run = func(_ ui, _ []job, reason string, events int, trigger, _ []string) (time.Time, int) {
+		runs <- fakeRun{reason: reason, events: events, trigger: trigger, time: time.Now()}
+		status := 0
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		return time.Now(), status
+	}
+	w.stopServer = func() {}
+	w.exit = func(int) { panic("exit") }
+	return w, runs
+}
+
+// nextRun returns the next run, failing the test if there is none within d.
+func nextRun(t *testing.T, runs <-chan fakeRun, d time.Duration) fakeRun {
+	t.Helper()
+	select {
+	case r := <-runs:
+		return r
+	case <-time.After(d):
+		t.Fatalf("no run after %s", d)
+		return fakeRun{}
+	}
+}
+
+// noRun fails the test if there is a run within d.
+func noRun(t *testing.T, runs <-chan fakeRun, d time.Duration) {
+	t.Helper()
+	select {
+	case r := <-runs:
+		t.Fatalf("unexpected run for %v", r.trigger)
+	case <-time.After(d):
+	}
+}
+
+func TestWatcherDebounce(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	changes := make(chan change)
+	defer close(changes)
+	w, runs := newTestWatcher(watchConfig{delaySuccess: delay, delayFailure: delay}, changes)
+	go w.loop()
+
+	noRun(t, runs, delay)
+	var last time.Time
+	for i, p := range []string{"a", "b", "a"} {
+		if i > 0 {
+			time.Sleep(delay / 5)
+		}
+		// The loop resets its timer after receiving the change,
+		// so the time of the send is a lower bound on the reset.
+		last = time.Now()
+		changes <- change{path: p, time: last, op: fsnotify.Write}
+	}
+	r := nextRun(t, runs, time.Second)
+	if want := []string{"b", "a"}; !reflect.DeepEqual(r.trigger, want) {
+		t.Errorf("trigger=%v, want %v", r.trigger, want)
+	}
+	if r.events != 3 {
+		t.Errorf("events=%d, want 3", r.events)
+	}
+	if r.reason != "" {
+		t.Errorf("reason=%q, want none", r.reason)
+	}
+	if d := r.time.Sub(last); d < delay {
+		t.Errorf("ran %s after the last change, want at least %s", d, delay)
+	}
+	noRun(t, runs, 2*delay)
+
+	changes <- change{path: "c", time: time.Now(), op: fsnotify.Write}
+	r = nextRun(t, runs, time.Second)
+	if want := []string{"c"}; !reflect.DeepEqual(r.trigger, want) {
+		t.Errorf("trigger=%v, want %v", r.trigger, want)
+	}
+}
+
+func TestWatcherRunAtStart(t *testing.T) {
+	changes := make(chan change)
+	defer close(changes)
+	w, runs := newTestWatcher(watchConfig{runAtStart: true}, changes)
+	go w.loop()
+	if r := nextRun(t, runs, time.Second); r.reason != "startup" || len(r.trigger) != 0 {
+		t.Errorf("run for %v, reason %q, want no changes, reason startup", r.trigger, r.reason)
+	}
+	noRun(t, runs, 50*time.Millisecond)
+}
+
+func TestWatcherRunAtStartPreempted(t *testing.T) {
+	changes := make(chan change)
+	defer close(changes)
+	const delay = 20 * time.Millisecond
+	w, runs := newTestWatcher(watchConfig{runAtStart: true, delaySuccess: delay, delayFailure: delay}, changes)
+	// A rerun before the loop starts, as by Get or -init.
+	w.doRun(w.jobs(nil, ""), "Get")
+	if r := nextRun(t, runs, time.Second); r.reason != "Get" {
+		t.Errorf("reason %q, want Get", r.reason)
+	}
+	go w.loop()
+	noRun(t, runs, 50*time.Millisecond)
+
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	if r := nextRun(t, runs, time.Second); r.reason != "" {
+		t.Errorf("run for a change has reason %q, want none", r.reason)
+	}
+}
+
+func TestWatcherDelayAfterFailure(t *testing.T) {
+	const (
+		success = 20 * time.Millisecond
+		failure = 200 * time.Millisecond
+	)
+	changes := make(chan change)
+	defer close(changes)
+	w, runs := newTestWatcher(watchConfig{delaySuccess: success, delayFailure: failure}, changes, 1, 0)
+	go w.loop()
+
+	start := time.Now()
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	if r := nextRun(t, runs, time.Second); r.time.Sub(start) >= failure {
+		t.Errorf("ran %s after the first change, want the success delay, %s", r.time.Sub(start), success)
+	}
+	start = time.Now()
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	r := nextRun(t, runs, time.Second)
+	if d := r.time.Sub(start); d < failure {
+		t.Errorf("ran %s after a change following a failure, want at least %s", d, failure)
+	}
+}
+
+func TestWatcherKillEager(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	changes := make(chan change)
+	defer close(changes)
+	w, runs := newTestWatcher(watchConfig{delaySuccess: delay, delayFailure: delay, restart: true, killEager: true}, changes)
+	stops := make(chan time.Time, 100)
+	w.stopServer = func() { stops <- time.Now() }
+	go w.loop()
+
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	changes <- change{path: "b", time: time.Now(), op: fsnotify.Write}
+	r := nextRun(t, runs, time.Second)
+	if len(stops) != 2 {
+		t.Fatalf("stopped the server %d times, want once on the first change and once before the run", len(stops))
+	}
+	if first := <-stops; r.time.Sub(first) < delay {
+		t.Errorf("stopped the server %s before the run, want at least %s", r.time.Sub(first), delay)
+	}
+}
+
+func TestWatcherMaxRuns(t *testing.T) {
+	changes := make(chan change)
+	w, runs := newTestWatcher(watchConfig{maxRuns: 2}, changes, 0, 3)
+	exits := make(chan int, 1)
+	w.exit = func(status int) {
+		exits <- status
+		close(changes)
+	}
+	go w.loop()
+
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	nextRun(t, runs, time.Second)
+	if len(exits) != 0 {
+		t.Fatalf("exited after 1 run, want 2")
+	}
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	nextRun(t, runs, time.Second)
+	select {
+	case s := <-exits:
+		if s != 3 {
+			t.Errorf("exited with %d, want 3", s)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("didn't exit after 2 runs")
+	}
+}
+
+// A fakeFileWatcher is a fileWatcher whose events are sent by the test.
+type fakeFileWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func (f *fakeFileWatcher) Add(string) error { return nil }
+
+func (f *fakeFileWatcher) Remove(string) error { return nil }
+
+func (f *fakeFileWatcher) Events() <-chan fsnotify.Event { return f.events }
+
+func (f *fakeFileWatcher) Errors() <-chan error { return f.errors }
+
+func TestWatcherFileEvents(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw := &fakeFileWatcher{events: make(chan fsnotify.Event), errors: make(chan error)}
+	skipTmp := func(ev fsnotify.Event, _ bool) string {
+		if strings.HasSuffix(ev.Name, ".tmp") {
+			return "it is temporary"
+		}
+		return ""
+	}
+	changes := make(chan change)
+	go sendChanges(fw, eventFilter{unchanged: skipTmp}, changes)
+	w, runs := newTestWatcher(watchConfig{delaySuccess: delay, delayFailure: delay}, changes)
+	go w.loop()
+
+	fw.events <- fsnotify.Event{Name: a, Op: fsnotify.Write}
+	fw.events <- fsnotify.Event{Name: a + ".tmp", Op: fsnotify.Write}
+	fw.events <- fsnotify.Event{Name: b, Op: fsnotify.Write}
+	r := nextRun(t, runs, time.Second)
+	if want := []string{a, b}; !reflect.DeepEqual(r.trigger, want) {
+		t.Errorf("trigger=%v, want %v", r.trigger, want)
+	}
+	noRun(t, runs, 2*delay)
+}
+
+func TestWatcherParallel(t *testing.T) {
+	changes := make(chan change)
+	defer close(changes)
+	w, _ := newTestWatcher(watchConfig{parallel: 2, maxRuns: 2}, changes)
+	started := make(chan string, 10)
+	release := make(chan struct{})
+	statuses := map[string]int{"a": 0, "b": 3}
+	w.run = func(_ ui, _ []job, _ string, _ int, trigger, _ []string) (time.Time, int) {
+		started <- trigger[0]
+		<-release
+		return time.Now(), statuses[trigger[0]]
+	}
+	exits := make(chan int, 1)
+	w.exit = func(status int) { exits <- status }
+	go w.loop()
+
+	changes <- change{path: "a", time: time.Now(), op: fsnotify.Write}
+	changes <- change{path: "b", time: time.Now(), op: fsnotify.Write}
+	// Both start before either finishes.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-started:
+			got[p] = true
+		case <-time.After(time.Second):
+			t.Fatalf("only %d runs started, want 2", i)
+		}
+	}
+	if !got["a"] || !got["b"] {
+		t.Fatalf("started runs for %v, want a and b", got)
+	}
+	// A change past -n doesn't start a run.
+	changes <- change{path: "c", time: time.Now(), op: fsnotify.Write}
+	close(release)
+	select {
+	case s := <-exits:
+		if s != 3 {
+			t.Errorf("exited with %d, want 3, the status of the last run started", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("didn't exit after 2 runs")
+	}
+	select {
+	case p := <-started:
+		t.Errorf("started a run for %s after -n runs", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
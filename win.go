@@ -6,20 +6,46 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"9fans.net/go/acme"
 )
 
+// tagCommands is written to the tag of the win.
+const tagCommands = "Get Stop Clear Watched Summary Reload "
+
 type winUI struct {
 	win *acme.Win
-	rr  chan struct{}
+	rr  chan string
+	// runs is the body offsets at which the kept runs start, for -keep-runs.
+	runs *[]int
 }
 
-func newWin(watchPath string) (ui, error) {
-	win, err := acme.New()
+// newWin returns a ui for a new acme win named for the directory dir,
+// with the -name suffix.
+// The name is based on the directory in which the command runs,
+// not the watched paths, so that relative paths in the output
+// resolve correctly however many paths are watched.
+func newWin(dir string) (ui, error) {
+	abs, err := filepath.Abs(dir)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("Failed getting the absolute path of " + dir + ": " + err.Error())
+	}
+	name := abs + "/" + *winName
+
+	var win *acme.Win
+	if *reuse {
+		if win, err = openWin(name); err != nil {
+			log.Println("Failed to reuse a win, creating a new one:", err)
+		}
+	}
+	if win == nil {
+		if win, err = acme.New(); err != nil {
+			return nil, err
+		}
 	}
 
 	wd, err := os.Getwd()
@@ -33,24 +59,67 @@ func newWin(watchPath string) (ui, error) {
 		log.Println("Failed to set the dump command:", err)
 	}
 
-	abs, err := filepath.Abs(watchPath)
-	if err != nil {
-		return nil, errors.New("Failed getting the absolute path of " + watchPath + ": " + err.Error())
-	}
-	if err := win.Name(abs + "/+watch"); err != nil {
+	if err := win.Name(name); err != nil {
 		return nil, errors.New("Failed to set the win name: " + err.Error())
 	}
 
+	if *font != "" {
+		if err := win.Ctl("font %s", *font); err != nil {
+			log.Println("Failed to set the font:", err)
+		}
+	}
+	if *tab > 0 {
+		if err := execTag(win, "Tab "+strconv.Itoa(*tab)); err != nil {
+			log.Println("Failed to set the tab width:", err)
+		}
+	}
+
+	win.Ctl("cleartag")
 	win.Ctl("clean")
-	win.Fprintf("tag", "Get ")
+	win.Fprintf("tag", tagCommands)
 
-	rerun := make(chan struct{})
+	rerun := make(chan string)
 	go events(win, rerun)
 
-	return winUI{win, rerun}, nil
+	return winUI{win, rerun, new([]int)}, nil
+}
+
+// openWin returns the existing win with the given name,
+// or nil if there is none.
+func openWin(name string) (*acme.Win, error) {
+	wins, err := acme.Windows()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range wins {
+		if w.Name == name {
+			debugPrint("Reusing win %d", w.ID)
+			return acme.Open(w.ID, nil)
+		}
+	}
+	return nil, nil
+}
+
+// execTag executes cmd in the win as if it was middle-clicked in the tag.
+// This is for commands, like Tab, that have no ctl message.
+func execTag(win *acme.Win, cmd string) error {
+	if err := win.Fprintf("tag", " %s", cmd); err != nil {
+		return err
+	}
+	tag, err := win.ReadAll("tag")
+	if err != nil {
+		return err
+	}
+	i := strings.LastIndex(string(tag), cmd)
+	if i < 0 {
+		return errors.New("command not found in the tag")
+	}
+	q0 := utf8.RuneCount(tag[:i])
+	q1 := q0 + utf8.RuneCountInString(cmd)
+	return win.WriteEvent(&acme.Event{C1: 'M', C2: 'x', OrigQ0: q0, OrigQ1: q1})
 }
 
-func events(win *acme.Win, rerun chan<- struct{}) {
+func events(win *acme.Win, rerun chan<- string) {
 	for e := range win.EventChan() {
 		debugPrint("Acme event: %+v\n", e)
 		switch e.C2 {
@@ -58,7 +127,24 @@ func events(win *acme.Win, rerun chan<- struct{}) {
 			switch string(e.Text) {
 			case "Get":
 				kill()
-				rerun <- struct{}{}
+				rerun <- "Get"
+
+			case "Stop":
+				kill()
+
+			case "Watched":
+				writeWatched(bodyWriter{win})
+
+			case "Summary":
+				writeSummary(bodyWriter{win})
+
+			case "Reload":
+				reload()
+
+			case "Clear":
+				win.Addr(",")
+				win.Write("data", nil)
+				win.Ctl("clean")
 
 			case "Del":
 				kill()
@@ -77,41 +163,156 @@ func events(win *acme.Win, rerun chan<- struct{}) {
 	os.Exit(0)
 }
 
-func (w winUI) rerun() <-chan struct{} {
+// setStatus shows the exit status in the tag, as [ok] or [exit N].
+// The rest of the user's text in the tag is kept.
+func (w winUI) setStatus(status int) {
+	s := "[ok]"
+	if status != 0 {
+		s = "[exit " + strconv.Itoa(status) + "]"
+	}
+	tag, err := w.win.ReadAll("tag")
+	if err != nil {
+		log.Println("Failed to read the tag:", err)
+		return
+	}
+	if err := w.win.Ctl("cleartag"); err != nil {
+		log.Println("Failed to clear the tag:", err)
+		return
+	}
+	w.win.Fprintf("tag", "%s", withStatus(string(tag), s))
+}
+
+// statusRE matches the status token written to the tag by setStatus.
+var statusRE = regexp.MustCompile(`\[(ok|exit -?[0-9]+)\] ?`)
+
+// withStatus returns the user's text of the tag, after the |,
+// with its status token replaced by s,
+// or with s appended if it has none.
+func withStatus(tag, s string) string {
+	if i := strings.Index(tag, "|"); i >= 0 {
+		tag = tag[i+1:]
+	}
+	tag = strings.TrimLeft(tag, " ")
+	if loc := statusRE.FindStringIndex(tag); loc != nil {
+		return tag[:loc[0]] + s + " " + tag[loc[1]:]
+	}
+	if tag != "" && !strings.HasSuffix(tag, " ") {
+		tag += " "
+	}
+	return tag + s + " "
+}
+
+func (w winUI) rerun() <-chan string {
 	return w.rr
 }
 
-func (w winUI) redisplay(f func(io.Writer)) {
-	w.win.Addr(",")
-	w.win.Write("data", nil)
+func (w winUI) redisplay(r runInfo) {
+	var q0 int
+	if *keepPos {
+		if err := w.win.Ctl("addr=dot"); err != nil {
+			log.Println("Failed to get dot:", err)
+		} else if q0, _, err = w.win.ReadAddr(); err != nil {
+			log.Println("Failed to read dot:", err)
+		}
+	}
+
+	start := 0
+	if *keepRuns > 1 {
+		start = w.appendRun()
+	} else {
+		w.win.Addr(",")
+		w.win.Write("data", nil)
+	}
 
-	f(bodyWriter{w.win})
+	r.write(bodyWriter{w.win})
 
-	w.win.Fprintf("addr", "#0")
+	// If the new output is shorter than q0, the address is out of range.
+	if q0 == 0 || w.win.Addr("#%d", q0) != nil {
+		w.win.Addr("#%d", start)
+	}
 	w.win.Ctl("dot=addr")
 	w.win.Ctl("show")
 	w.win.Ctl("clean")
 }
 
+// appendRun starts a new run at the end of the body,
+// below a delimiter, and deletes the oldest runs
+// so that at most -keep-runs are kept.
+// It returns the offset at which the new run starts.
+func (w winUI) appendRun() int {
+	if err := w.win.Addr("$"); err != nil {
+		log.Println("Failed to find the end of the body:", err)
+	}
+	end, _, err := w.win.ReadAddr()
+	if err != nil {
+		log.Println("Failed to read the end of the body:", err)
+	}
+	if end == 0 {
+		// The body is empty, perhaps cleared with Clear.
+		*w.runs = nil
+	} else {
+		delim := "\n" + strings.Repeat("=", 40) + "\n"
+		w.win.Write("body", []byte(delim))
+		end += utf8.RuneCountInString(delim)
+	}
+	runs := append(*w.runs, end)
+	if n := len(runs) - *keepRuns; n > 0 {
+		cut := runs[n]
+		if err := w.win.Addr("#0,#%d", cut); err != nil {
+			log.Println("Failed to trim old runs:", err)
+		} else {
+			w.win.Write("data", nil)
+			runs = runs[n:]
+			for i := range runs {
+				runs[i] -= cut
+			}
+		}
+	}
+	*w.runs = runs
+	return runs[len(runs)-1]
+}
+
+// defaultChunkSize is the default -chunk-size,
+// the most data that acme accepts in a single 9P message.
+// Larger writes are split into messages of this size anyway.
+const defaultChunkSize = 8192
+
+// A bodyWriter writes to the body of an acme win.
+// Writes are not buffered; each goes directly to acme's body file,
+// so output is displayed as soon as the command writes it.
 type bodyWriter struct {
-	*acme.Win
+	win fileWriter
+}
+
+// A fileWriter writes to the files of an acme win, such as its body.
+// It is implemented by *acme.Win.
+type fileWriter interface {
+	Write(file string, b []byte) (int, error)
 }
 
 func (b bodyWriter) Write(data []byte) (int, error) {
 	// maxWrite is the maximum amount of data written at a time to an win's body.
-	const maxWrite = 1024
+	maxWrite := *chunkSize
+	if maxWrite <= 0 {
+		maxWrite = defaultChunkSize
+	}
 
-	sz := len(data)
-	for len(data) > 0 {
-		n := maxWrite
-		if len(data) < n {
-			n = len(data)
+	// Each chunk starts after the bytes actually written,
+	// so a short write is retried from where it stopped.
+	var n int
+	for n < len(data) {
+		chunk := data[n:]
+		if len(chunk) > maxWrite {
+			chunk = chunk[:maxWrite]
 		}
-		m, err := b.Win.Write("body", data[:n])
+		m, err := b.win.Write("body", chunk)
+		n += m
 		if err != nil {
-			return m, err
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
 		}
-		data = data[m:]
 	}
-	return sz, nil
+	return n, nil
 }
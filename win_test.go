@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// A fakeWin is a fileWriter that records the data written to the body,
+// accepting at most the next of ns bytes of each write,
+// or returning err if it is negative.
+// Once ns is exhausted, writes accept everything.
+type fakeWin struct {
+	ns   []int
+	err  error
+	body []byte
+}
+
+func (f *fakeWin) Write(file string, b []byte) (int, error) {
+	if file != "body" {
+		return 0, errors.New("wrote " + file)
+	}
+	if len(f.ns) == 0 {
+		f.body = append(f.body, b...)
+		return len(b), nil
+	}
+	n := f.ns[0]
+	f.ns = f.ns[1:]
+	if n < 0 {
+		return 0, f.err
+	}
+	if n > len(b) {
+		n = len(b)
+	}
+	f.body = append(f.body, b[:n]...)
+	return n, nil
+}
+
+func TestBodyWriter(t *testing.T) {
+	defer func(n int) { *chunkSize = n }(*chunkSize)
+	*chunkSize = 4
+
+	errWrite := errors.New("write failed")
+	tests := []struct {
+		name    string
+		ns      []int
+		err     error
+		data    string
+		n       int
+		wantErr error
+	}{
+		{name: "full writes", data: "0123456789", n: 10},
+		{name: "short writes", ns: []int{1, 3, 2}, data: "0123456789", n: 10},
+		{name: "no progress", ns: []int{2, 0}, data: "0123456789", n: 2, wantErr: io.ErrShortWrite},
+		{name: "error", ns: []int{4, 3, -1}, err: errWrite, data: "0123456789", n: 7, wantErr: errWrite},
+		{name: "empty", data: "", n: 0},
+	}
+	for _, test := range tests {
+		f := &fakeWin{ns: test.ns, err: test.err}
+		n, err := bodyWriter{f}.Write([]byte(test.data))
+		if n != test.n || err != test.wantErr {
+			t.Errorf("%s: Write(%q)=%d, %v, want %d, %v", test.name, test.data, n, err, test.n, test.wantErr)
+		}
+		if string(f.body) != test.data[:n] {
+			t.Errorf("%s: body is %q, want %q", test.name, f.body, test.data[:n])
+		}
+	}
+}
+
+func TestWithStatus(t *testing.T) {
+	tests := []struct {
+		name, tag, s, want string
+	}{
+		{
+			name: "no status",
+			tag:  "/a/+watch Del Snarf | " + tagCommands,
+			s:    "[ok]",
+			want: tagCommands + "[ok] ",
+		},
+		{
+			name: "replace status",
+			tag:  "/a/+watch Del Snarf | " + tagCommands + "[ok] ",
+			s:    "[exit 1]",
+			want: tagCommands + "[exit 1] ",
+		},
+		{
+			name: "keep user text",
+			tag:  "/a/+watch Del Snarf | " + tagCommands + "[exit 2] Look foo",
+			s:    "[ok]",
+			want: tagCommands + "[ok] Look foo",
+		},
+		{
+			name: "user text without a status",
+			tag:  "/a/+watch Del Snarf | " + tagCommands + "mk test",
+			s:    "[ok]",
+			want: tagCommands + "mk test [ok] ",
+		},
+		{
+			name: "no bar",
+			tag:  "",
+			s:    "[ok]",
+			want: "[ok] ",
+		},
+	}
+	for _, test := range tests {
+		if got := withStatus(test.tag, test.s); got != test.want {
+			t.Errorf("%s: withStatus(%q, %q)=%q, want %q", test.name, test.tag, test.s, got, test.want)
+		}
+	}
+}